@@ -1,21 +1,30 @@
 package ftp
 
 import (
+	"os"
+
 	"github.com/alpacanetworks/alpamon/pkg/logger"
 	"github.com/alpacanetworks/alpamon/pkg/runner"
 	"github.com/spf13/cobra"
 )
 
 var FtpCmd = &cobra.Command{
-	Use:   "ftp <url> <homeDirectory>",
+	Use:   "ftp <homeDirectory>",
 	Short: "Start worker for Web FTP",
-	Args:  cobra.ExactArgs(3),
+	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		ftpLogger := logger.NewFtpLogger()
+
+		conn, err := runner.OpenFtpWorkerConn()
+		if err != nil {
+			ftpLogger.Error().Err(err).Msg("Failed to open the connection to alpamon.")
+			os.Exit(1)
+		}
+
 		data := runner.FtpConfigData{
-			URL:           args[0],
-			ServerURL:     args[1],
-			HomeDirectory: args[2],
-			Logger:        logger.NewFtpLogger(),
+			HomeDirectory: args[0],
+			Logger:        ftpLogger,
+			Conn:          conn,
 		}
 
 		RunFtpWorker(data)
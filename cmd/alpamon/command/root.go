@@ -10,6 +10,8 @@ import (
 	"github.com/alpacanetworks/alpamon/cmd/alpamon/command/ftp"
 	"github.com/alpacanetworks/alpamon/cmd/alpamon/command/setup"
 	"github.com/alpacanetworks/alpamon/pkg/collector"
+	"github.com/alpacanetworks/alpamon/pkg/collector/check"
+	"github.com/alpacanetworks/alpamon/pkg/collector/check/realtime/status"
 	"github.com/alpacanetworks/alpamon/pkg/config"
 	"github.com/alpacanetworks/alpamon/pkg/db"
 	"github.com/alpacanetworks/alpamon/pkg/logger"
@@ -75,8 +77,11 @@ func runAgent() {
 	session := scheduler.InitSession()
 	commissioned := session.CheckSession(ctx)
 
+	// DB
+	client := db.InitDB()
+
 	// Reporter
-	scheduler.StartReporters(session)
+	scheduler.StartReporters(session, client)
 
 	// Log server
 	logServer := logger.NewLogServer()
@@ -89,17 +94,16 @@ func runAgent() {
 	// Commit
 	runner.CommitAsync(session, commissioned)
 
-	// DB
-	client := db.InitDB()
-
 	// Collector
+	status.SetConnectionStats(func() interface{} { return runner.GetConnectionStats() })
 	metricCollector := collector.InitCollector(session, client)
 	if metricCollector != nil {
 		metricCollector.Start()
 	}
 
 	// Websocket Client
-	wsClient := runner.NewWebsocketClient(session)
+	runner.SetCheckTypes(check.Types())
+	wsClient := runner.NewWebsocketClient(session, client)
 	go wsClient.RunForever(ctx)
 
 	for {
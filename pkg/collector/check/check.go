@@ -3,6 +3,7 @@ package check
 import (
 	"context"
 	"fmt"
+	"sort"
 
 	"github.com/alpacanetworks/alpamon/pkg/collector/check/base"
 	cleanup "github.com/alpacanetworks/alpamon/pkg/collector/check/batch/daily/cleanup"
@@ -67,3 +68,14 @@ func (f *DefaultCheckFactory) CreateCheck(args *base.CheckArgs) (base.CheckStrat
 
 	return nil, fmt.Errorf("unknown check type: %s", args.Type)
 }
+
+// Types returns the check types this build can run.
+func Types() []string {
+	types := make([]string, 0, len(checkFactories))
+	for checkType := range checkFactories {
+		types = append(types, string(checkType))
+	}
+	sort.Strings(types)
+
+	return types
+}
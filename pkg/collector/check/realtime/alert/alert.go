@@ -29,7 +29,7 @@ func (c *Check) Execute(ctx context.Context) error {
 		Record:      "alert",
 		Description: "Alert: detected anomaly",
 	}
-	scheduler.Rqueue.Post(alertURL, data, 80, time.Time{})
+	scheduler.Rqueue.Post(alertURL, data, 80, time.Time{}, 0)
 
 	return nil
 }
@@ -12,6 +12,14 @@ const (
 	statusURL = "/api/servers/servers/-/status/"
 )
 
+// connectionStats is set by SetConnectionStats, as the runner can not be imported from here.
+var connectionStats func() interface{}
+
+// SetConnectionStats sets the function that returns the quality of the backhaul connection.
+func SetConnectionStats(stats func() interface{}) {
+	connectionStats = stats
+}
+
 type Check struct {
 	base.BaseCheck
 }
@@ -23,7 +31,14 @@ func NewCheck(args *base.CheckArgs) base.CheckStrategy {
 }
 
 func (c *Check) Execute(ctx context.Context) error {
-	scheduler.Rqueue.Patch(statusURL, nil, 80, time.Time{})
+	// the status is sent even without a payload, as it tells Alpacon the server is alive
+	var data interface{}
+	if connectionStats != nil {
+		data = map[string]interface{}{
+			"connection": connectionStats(),
+		}
+	}
+	scheduler.Rqueue.Patch(statusURL, data, 80, time.Time{}, 0)
 
 	return nil
 }
@@ -1,11 +1,18 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -15,11 +22,17 @@ import (
 
 var (
 	GlobalSettings Settings
+
+	// keyMu guards GlobalSettings.Key, which rotatekey replaces while alpamon is running
+	keyMu sync.RWMutex
 )
 
 const (
-	MinConnectInterval = 5 * time.Second
-	MaxConnectInterval = 300 * time.Second
+	MinConnectInterval  = 5 * time.Second
+	MaxConnectInterval  = 300 * time.Second
+	DefaultSpoolSize    = 10 * 60 * 60 * 24 // 10 entries/second * 24h
+	DefaultPingInterval = 30 * time.Second
+	DefaultSigningAge   = 5 * time.Minute
 )
 
 func InitSettings(settings Settings) {
@@ -74,6 +87,7 @@ func LoadConfig(configFiles []string, wsPath string) Settings {
 	}
 
 	isValid, settings := validateConfig(config, wsPath)
+	settings.ConfigFile = validConfigFile
 
 	if !isValid {
 		log.Fatal().Msg("Aborting...")
@@ -86,23 +100,43 @@ func validateConfig(config Config, wsPath string) (bool, Settings) {
 	log.Debug().Msg("Validating configuration fields...")
 
 	settings := Settings{
-		WSPath:      wsPath,
-		UseSSL:      false,
-		SSLVerify:   true,
-		SSLOpt:      make(map[string]interface{}),
-		HTTPThreads: 4,
+		WSPath:        wsPath,
+		UseSSL:        false,
+		SSLVerify:     true,
+		SSLOpt:        make(map[string]interface{}),
+		HTTPThreads:   4,
+		SpoolSize:     DefaultSpoolSize,
+		PingInterval:  DefaultPingInterval,
+		SigningMaxAge: DefaultSigningAge,
 	}
 
 	valid := true
-	val := config.Server.URL
-	if strings.HasPrefix(val, "http://") || strings.HasPrefix(val, "https://") {
-		val = strings.TrimSuffix(val, "/")
-		settings.ServerURL = val
-		settings.WSPath = strings.Replace(val, "http", "ws", 1) + settings.WSPath
-		settings.UseSSL = strings.HasPrefix(val, "https://")
-	} else {
-		log.Error().Msg("Server url is invalid.")
-		valid = false
+	for _, val := range strings.Split(config.Server.URL, ",") {
+		val = strings.TrimSpace(val)
+		if strings.HasPrefix(val, "http://") || strings.HasPrefix(val, "https://") {
+			val = strings.TrimSuffix(val, "/")
+			settings.Endpoints = append(settings.Endpoints, Endpoint{
+				ServerURL: val,
+				WSPath:    strings.Replace(val, "http", "ws", 1) + wsPath,
+				UseSSL:    strings.HasPrefix(val, "https://"),
+			})
+		} else {
+			log.Error().Msgf("Server url is invalid: %s.", val)
+			valid = false
+		}
+	}
+	if len(settings.Endpoints) > 0 {
+		settings.ServerURL = settings.Endpoints[0].ServerURL
+		settings.WSPath = settings.Endpoints[0].WSPath
+		settings.UseSSL = settings.Endpoints[0].UseSSL
+	}
+	// failing over from https to http would drop TLS without notice
+	for _, endpoint := range settings.Endpoints {
+		if endpoint.UseSSL != settings.UseSSL {
+			log.Error().Msg("Server urls must all be http:// or all be https://.")
+			valid = false
+			break
+		}
 	}
 
 	if config.Server.ID != "" && config.Server.Key != "" {
@@ -132,9 +166,229 @@ func validateConfig(config Config, wsPath string) (bool, Settings) {
 			}
 		}
 	}
+
+	for _, pin := range strings.Split(config.SSL.Pins, ",") {
+		pin = strings.TrimSpace(pin)
+		if pin == "" {
+			continue
+		}
+		hash, err := parsePin(pin)
+		if err != nil {
+			log.Error().Err(err).Msgf("Invalid certificate pin: %s.", pin)
+			valid = false
+			continue
+		}
+		settings.SSLPins = append(settings.SSLPins, hash)
+	}
+
+	clientCert, clientKey := config.SSL.ClientCert, config.SSL.ClientKey
+	if clientCert != "" || clientKey != "" {
+		if clientCert == "" || clientKey == "" {
+			log.Error().Msg("Both client_cert and client_key are required for mutual TLS.")
+			valid = false
+		} else if _, err := tls.LoadX509KeyPair(clientCert, clientKey); err != nil {
+			log.Error().Err(err).Msg("Failed to load client certificate.")
+			valid = false
+		} else {
+			settings.ClientCert = clientCert
+			settings.ClientKey = clientKey
+		}
+	}
+
+	if config.Proxy.URL != "" {
+		proxyURL, err := url.Parse(config.Proxy.URL)
+		if err != nil || proxyURL.Host == "" || (proxyURL.Scheme != "http" && proxyURL.Scheme != "socks5") {
+			log.Error().Msg("Proxy url is invalid, it must be http:// or socks5://.")
+			valid = false
+		} else {
+			settings.ProxyURL = config.Proxy.URL
+			settings.ProxyUsername = config.Proxy.Username
+			settings.ProxyPassword = config.Proxy.Password
+			settings.NoProxy = config.Proxy.NoProxy
+		}
+	}
+
+	switch config.Server.Compression {
+	case "", "none":
+	case "gzip":
+		settings.Compression = config.Server.Compression
+	default:
+		log.Error().Msgf("Unsupported compression: %s.", config.Server.Compression)
+		valid = false
+	}
+
+	if config.Server.PingInterval > 0 {
+		settings.PingInterval = time.Duration(config.Server.PingInterval) * time.Second
+	} else if config.Server.PingInterval < 0 {
+		log.Error().Msg("Server ping_interval must be a positive number.")
+		valid = false
+	}
+
+	if config.Signing.PublicKey != "" {
+		key, err := parseSigningKey(config.Signing.PublicKey)
+		if err != nil {
+			log.Error().Err(err).Msg("Invalid signing public_key.")
+			valid = false
+		} else {
+			settings.SigningKey = key
+		}
+	}
+	if config.Signing.Enforce {
+		if config.Signing.PublicKey == "" {
+			log.Error().Msg("Signing public_key is required to enforce command signatures.")
+			valid = false
+		}
+		settings.SigningEnforce = true
+	}
+	if config.Signing.MaxAge > 0 {
+		settings.SigningMaxAge = time.Duration(config.Signing.MaxAge) * time.Second
+	} else if config.Signing.MaxAge < 0 {
+		log.Error().Msg("Signing max_age must be a positive number.")
+		valid = false
+	}
+
+	settings.Limits = Limits{
+		CPUMax:    strings.TrimSpace(config.Limits.CPUMax),
+		MemoryMax: strings.TrimSpace(config.Limits.MemoryMax),
+		PidsMax:   strings.TrimSpace(config.Limits.PidsMax),
+	}
+	if err := settings.Limits.Validate(); err != nil {
+		log.Error().Err(err).Msg("Invalid resource limits.")
+		valid = false
+	}
+
+	settings.UseSpool = config.Spool.Enabled
+	if config.Spool.MaxSize > 0 {
+		settings.SpoolSize = config.Spool.MaxSize
+	} else if config.Spool.MaxSize < 0 {
+		log.Error().Msg("Spool max_size must be a positive number.")
+		valid = false
+	}
+
 	return valid, settings
 }
 
+// ServerKey returns the current server key.
+func ServerKey() string {
+	keyMu.RLock()
+	defer keyMu.RUnlock()
+
+	return GlobalSettings.Key
+}
+
+// SetServerKey replaces the server key used for new requests and connections.
+func SetServerKey(key string) {
+	keyMu.Lock()
+	defer keyMu.Unlock()
+
+	GlobalSettings.Key = key
+}
+
+// SaveKey replaces the server key in the loaded config file.
+// The file is rewritten atomically, keeping its permissions and everything but the key line as is.
+func SaveKey(key string) error {
+	path := GlobalSettings.ConfigFile
+	if path == "" {
+		return fmt.Errorf("config file is unknown")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.SplitAfter(string(content), "\n")
+	section := ""
+	replaced := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			continue
+		}
+		name, _, found := strings.Cut(trimmed, "=")
+		if section == "server" && found && strings.TrimSpace(name) == "key" {
+			lines[i] = fmt.Sprintf("key = %s\n", key)
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		return fmt.Errorf("key is not found in %s", path)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	_, err = tmp.WriteString(strings.Join(lines, ""))
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			err = tmp.Chown(int(stat.Uid), int(stat.Gid))
+		}
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// parsePin decodes a base64 SHA-256 hash of a subject public key info,
+// optionally prefixed with "sha256//" as printed by curl and openssl.
+func parsePin(pin string) ([]byte, error) {
+	pin = strings.TrimPrefix(pin, "sha256//")
+	pin = strings.TrimPrefix(pin, "sha256/")
+
+	hash, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil {
+		return nil, err
+	}
+	if len(hash) != sha256.Size {
+		return nil, fmt.Errorf("expected %d bytes, got %d", sha256.Size, len(hash))
+	}
+
+	return hash, nil
+}
+
+// parseSigningKey decodes a base64 Ed25519 public key,
+// either the raw 32 bytes or DER encoded as printed by `openssl pkey -pubout -outform der`.
+func parseSigningKey(value string) (ed25519.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(der) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(der), nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an Ed25519 key, got %T", key)
+	}
+
+	return edKey, nil
+}
+
 func Files(name string) []string {
 	return []string{
 		fmt.Sprintf("/etc/alpamon/%s.conf", name),
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// The active endpoint is switched to the next one after this many consecutive connection failures.
+const maxEndpointFailures = 3
+
+// endpoints tracks which of GlobalSettings.Endpoints is in use. The backhaul, the API session
+// and Websh/FTP channels all connect to the active endpoint, so they fail over together.
+var endpoints = &endpointState{}
+
+type endpointState struct {
+	mu       sync.RWMutex
+	index    int
+	failures int
+}
+
+// ActiveEndpoint returns the endpoint to connect to.
+func ActiveEndpoint() Endpoint {
+	endpoints.mu.RLock()
+	defer endpoints.mu.RUnlock()
+
+	if endpoints.index >= len(GlobalSettings.Endpoints) {
+		return Endpoint{ServerURL: GlobalSettings.ServerURL, WSPath: GlobalSettings.WSPath}
+	}
+
+	return GlobalSettings.Endpoints[endpoints.index]
+}
+
+// IsPrimaryActive reports whether the primary endpoint is in use.
+func IsPrimaryActive() bool {
+	endpoints.mu.RLock()
+	defer endpoints.mu.RUnlock()
+
+	return endpoints.index == 0
+}
+
+// EndpointFailed records a failed connection to serverURL. After maxEndpointFailures consecutive
+// failures of the active endpoint, the next endpoint in the list becomes active.
+// Failures of an endpoint that is no longer active are ignored.
+func EndpointFailed(serverURL string) {
+	endpoints.mu.Lock()
+	defer endpoints.mu.Unlock()
+
+	if len(GlobalSettings.Endpoints) < 2 || GlobalSettings.Endpoints[endpoints.index].ServerURL != serverURL {
+		return
+	}
+
+	endpoints.failures++
+	if endpoints.failures < maxEndpointFailures {
+		return
+	}
+
+	endpoints.failures = 0
+	endpoints.index = (endpoints.index + 1) % len(GlobalSettings.Endpoints)
+	log.Warn().Msgf("%s is unreachable, failing over to %s.", serverURL, GlobalSettings.Endpoints[endpoints.index].ServerURL)
+}
+
+// EndpointSucceeded resets the failure count of serverURL if it is active.
+func EndpointSucceeded(serverURL string) {
+	endpoints.mu.Lock()
+	defer endpoints.mu.Unlock()
+
+	if len(GlobalSettings.Endpoints) > 0 && GlobalSettings.Endpoints[endpoints.index].ServerURL == serverURL {
+		endpoints.failures = 0
+	}
+}
+
+// FailBack makes the primary endpoint active again.
+func FailBack() {
+	endpoints.mu.Lock()
+	defer endpoints.mu.Unlock()
+
+	if endpoints.index == 0 {
+		return
+	}
+
+	log.Info().Msgf("%s is healthy again, failing back from %s.",
+		GlobalSettings.Endpoints[0].ServerURL, GlobalSettings.Endpoints[endpoints.index].ServerURL)
+	endpoints.index = 0
+	endpoints.failures = 0
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Limits are cgroup v2 resource limits for executed commands, in the format of the
+// cgroup interface files. Empty values are not limited.
+type Limits struct {
+	CPUMax    string `json:"cpu_max"`    // "$QUOTA $PERIOD" in microseconds, e.g. "50000 100000" for half a CPU
+	MemoryMax string `json:"memory_max"` // bytes, optionally suffixed with K, M, G or T
+	PidsMax   string `json:"pids_max"`
+}
+
+// IsZero reports whether no limit is set.
+func (l Limits) IsZero() bool {
+	return l.CPUMax == "" && l.MemoryMax == "" && l.PidsMax == ""
+}
+
+// Override returns l with the limits set in o replacing its own.
+func (l Limits) Override(o Limits) Limits {
+	if o.CPUMax != "" {
+		l.CPUMax = o.CPUMax
+	}
+	if o.MemoryMax != "" {
+		l.MemoryMax = o.MemoryMax
+	}
+	if o.PidsMax != "" {
+		l.PidsMax = o.PidsMax
+	}
+	return l
+}
+
+// Validate checks the limits before they are written, as the kernel only reports EINVAL.
+func (l Limits) Validate() error {
+	if l.CPUMax != "" {
+		fields := strings.Fields(l.CPUMax)
+		if len(fields) == 0 || len(fields) > 2 || (fields[0] != "max" && !isPositive(fields[0])) {
+			return fmt.Errorf("cpu_max must be \"$QUOTA $PERIOD\": %s", l.CPUMax)
+		}
+		if len(fields) == 2 {
+			period, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil || period < 1000 || period > 1000000 {
+				return fmt.Errorf("cpu_max period must be between 1000 and 1000000: %s", l.CPUMax)
+			}
+		}
+	}
+	if l.MemoryMax != "" && l.MemoryMax != "max" {
+		number := strings.TrimRight(l.MemoryMax, "KMGTkmgt")
+		if len(l.MemoryMax)-len(number) > 1 || !isPositive(number) {
+			return fmt.Errorf("memory_max must be a number of bytes: %s", l.MemoryMax)
+		}
+	}
+	if l.PidsMax != "" && l.PidsMax != "max" && !isPositive(l.PidsMax) {
+		return fmt.Errorf("pids_max must be a positive number: %s", l.PidsMax)
+	}
+	return nil
+}
+
+func isPositive(value string) bool {
+	n, err := strconv.ParseUint(value, 10, 64)
+	return err == nil && n > 0
+}
@@ -1,27 +1,81 @@
 package config
 
+import (
+	"crypto/ed25519"
+	"time"
+)
+
 type Settings struct {
-	ServerURL   string
-	WSPath      string
-	UseSSL      bool
-	CaCert      string // CA certificate file path
-	SSLVerify   bool
-	SSLOpt      map[string]interface{}
-	HTTPThreads int
-	ID          string
-	Key         string
+	ConfigFile     string // path of the loaded config file
+	ServerURL      string // URL of the primary endpoint, see ActiveEndpoint for the one in use
+	WSPath         string
+	Endpoints      []Endpoint // in order of preference, the first is the primary
+	UseSSL         bool
+	CaCert         string // CA certificate file path
+	ClientCert     string // client certificate file path for mutual TLS
+	ClientKey      string // client private key file path for mutual TLS
+	SSLVerify      bool
+	SSLPins        [][]byte // SHA-256 hashes of the pinned subject public keys
+	SSLOpt         map[string]interface{}
+	HTTPThreads    int
+	ID             string
+	Key            string // read with ServerKey, as it can be rotated at runtime
+	UseSpool       bool
+	SpoolSize      int
+	Compression    string // content coding for request bodies, empty if disabled
+	ProxyURL       string // empty to use HTTPS_PROXY/NO_PROXY of the environment
+	ProxyUsername  string
+	ProxyPassword  string
+	NoProxy        string
+	PingInterval   time.Duration     // interval of websocket pings to detect a dead backhaul
+	SigningKey     ed25519.PublicKey // verifies command signatures, nil if not configured
+	SigningEnforce bool              // reject unsigned commands
+	SigningMaxAge  time.Duration     // maximum age of a signed command
+	Limits         Limits            // default resource limits of executed commands
+}
+
+// Endpoint is an Alpacon server the agent can connect to.
+type Endpoint struct {
+	ServerURL string
+	WSPath    string
+	UseSSL    bool // https, all endpoints share the same scheme
 }
 
 type Config struct {
 	Server struct {
-		URL string `ini:"url"`
-		ID  string `ini:"id"`
-		Key string `ini:"key"`
+		URL          string `ini:"url"`
+		ID           string `ini:"id"`
+		Key          string `ini:"key"`
+		Compression  string `ini:"compression"`
+		PingInterval int    `ini:"ping_interval"`
 	} `ini:"server"`
 	SSL struct {
-		Verify bool   `ini:"verify"`
-		CaCert string `ini:"ca_cert"`
+		Verify     bool   `ini:"verify"`
+		CaCert     string `ini:"ca_cert"`
+		ClientCert string `ini:"client_cert"`
+		ClientKey  string `ini:"client_key"`
+		Pins       string `ini:"pins"`
 	} `ini:"ssl"`
+	Proxy struct {
+		URL      string `ini:"url"`
+		Username string `ini:"username"`
+		Password string `ini:"password"`
+		NoProxy  string `ini:"no_proxy"`
+	} `ini:"proxy"`
+	Signing struct {
+		PublicKey string `ini:"public_key"`
+		Enforce   bool   `ini:"enforce"`
+		MaxAge    int    `ini:"max_age"`
+	} `ini:"signing"`
+	Limits struct {
+		CPUMax    string `ini:"cpu_max"`
+		MemoryMax string `ini:"memory_max"`
+		PidsMax   string `ini:"pids_max"`
+	} `ini:"limits"`
+	Spool struct {
+		Enabled bool `ini:"enabled"`
+		MaxSize int  `ini:"max_size"`
+	} `ini:"spool"`
 	Logging struct {
 		Debug bool `ini:"debug"`
 	} `ini:"logging"`
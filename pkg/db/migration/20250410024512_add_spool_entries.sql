@@ -0,0 +1,4 @@
+-- Create "spool_entries" table
+CREATE TABLE `spool_entries` (`id` integer NOT NULL PRIMARY KEY AUTOINCREMENT, `priority` integer NOT NULL, `method` text NOT NULL, `url` text NOT NULL, `data` blob NULL, `due` datetime NOT NULL, `expiry` datetime NULL, `retry` integer NOT NULL);
+-- Create index "spoolentry_priority_due" to table: "spool_entries"
+CREATE INDEX `spoolentry_priority_due` ON `spool_entries` (`priority`, `due`);
@@ -0,0 +1,8 @@
+-- Create "commands" table
+CREATE TABLE `commands` (`id` integer NOT NULL PRIMARY KEY AUTOINCREMENT, `command_id` text NOT NULL, `shell` text NOT NULL, `line` text NOT NULL, `state` text NOT NULL, `fin` blob NULL, `created_at` datetime NOT NULL, `finished_at` datetime NULL);
+-- Create index "commands_command_id_key" to table: "commands"
+CREATE UNIQUE INDEX `commands_command_id_key` ON `commands` (`command_id`);
+-- Create index "command_state" to table: "commands"
+CREATE INDEX `command_state` ON `commands` (`state`);
+-- Create index "command_created_at" to table: "commands"
+CREATE INDEX `command_created_at` ON `commands` (`created_at`);
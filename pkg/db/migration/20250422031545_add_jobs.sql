@@ -0,0 +1,8 @@
+-- Create "jobs" table
+CREATE TABLE `jobs` (`id` integer NOT NULL PRIMARY KEY AUTOINCREMENT, `job_id` text NOT NULL, `command` blob NOT NULL, `cron` text NULL, `state` text NOT NULL, `next_run_at` datetime NOT NULL, `last_run_at` datetime NULL, `runs` integer NOT NULL DEFAULT (0), `created_at` datetime NOT NULL);
+-- Create index "jobs_job_id_key" to table: "jobs"
+CREATE UNIQUE INDEX `jobs_job_id_key` ON `jobs` (`job_id`);
+-- Create index "job_state_next_run_at" to table: "jobs"
+CREATE INDEX `job_state_next_run_at` ON `jobs` (`state`, `next_run_at`);
+-- Create index "job_created_at" to table: "jobs"
+CREATE INDEX `job_created_at` ON `jobs` (`created_at`);
@@ -0,0 +1,33 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// Command holds the schema definition for the Command entity.
+// It records the commands received from Alpacon so that re-delivered ones are not run twice.
+type Command struct {
+	ent.Schema
+}
+
+// Fields of the Command.
+func (Command) Fields() []ent.Field {
+	return []ent.Field{
+		field.String("command_id").Unique(),
+		field.String("shell"),
+		field.String("line"),
+		field.Enum("state").Values("running", "finished"),
+		field.Bytes("fin").Optional(),
+		field.Time("created_at"),
+		field.Time("finished_at").Optional(),
+	}
+}
+
+func (Command) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("state"),
+		index.Fields("created_at"),
+	}
+}
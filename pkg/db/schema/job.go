@@ -0,0 +1,34 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// Job holds the schema definition for the Job entity.
+// It records the commands scheduled to run later or on a cron schedule, even while Alpacon is unreachable.
+type Job struct {
+	ent.Schema
+}
+
+// Fields of the Job.
+func (Job) Fields() []ent.Field {
+	return []ent.Field{
+		field.String("job_id").Unique(),
+		field.Bytes("command"),
+		field.String("cron").Optional(),
+		field.Enum("state").Values("scheduled", "finished", "cancelled"),
+		field.Time("next_run_at"),
+		field.Time("last_run_at").Optional(),
+		field.Int("runs").Default(0),
+		field.Time("created_at"),
+	}
+}
+
+func (Job) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("state", "next_run_at"),
+		index.Fields("created_at"),
+	}
+}
@@ -0,0 +1,32 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// SpoolEntry holds the schema definition for the SpoolEntry entity.
+// Each row mirrors a request waiting in scheduler.RequestQueue.
+type SpoolEntry struct {
+	ent.Schema
+}
+
+// Fields of the SpoolEntry.
+func (SpoolEntry) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int("priority"),
+		field.String("method"),
+		field.String("url"),
+		field.Bytes("data").Optional(),
+		field.Time("due"),
+		field.Time("expiry").Optional(),
+		field.Int("retry"),
+	}
+}
+
+func (SpoolEntry) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("priority", "due"),
+	}
+}
@@ -48,6 +48,7 @@ type logRecordWriter struct{}
 var logRecordFileHandlers = map[string]int{
 	"command.go": 30,
 	"commit.go":  20,
+	"policy.go":  30,
 	"pty.go":     30,
 	"shell.go":   30,
 	"server.go":  40, // logger/server.go
@@ -140,7 +141,7 @@ func (w *logRecordWriter) Write(p []byte) (n int, err error) {
 		if scheduler.Rqueue == nil {
 			return
 		}
-		scheduler.Rqueue.Post(recordURL, record, 90, time.Time{})
+		scheduler.Rqueue.Post(recordURL, record, 90, time.Time{}, 0)
 	}()
 
 	return n, nil
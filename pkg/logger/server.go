@@ -92,7 +92,7 @@ func (ls *LogServer) handleRecord(record LogRecord) {
 	if scheduler.Rqueue == nil {
 		return
 	}
-	scheduler.Rqueue.Post(recordURL, record, 90, time.Time{})
+	scheduler.Rqueue.Post(recordURL, record, 90, time.Time{}, 0)
 }
 
 func (ls *LogServer) Stop() {
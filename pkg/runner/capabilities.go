@@ -0,0 +1,96 @@
+package runner
+
+import (
+	"sort"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/alpacanetworks/alpamon/pkg/version"
+	"github.com/rs/zerolog/log"
+)
+
+// These lists must be kept in sync with CommandRequestHandler and CommandRunner.Run.
+// Internal commands are listed from internalCmds.
+var (
+	supportedQueries = []string{"command", "cancel", "quit", "reconnect"}
+	supportedShells  = []string{"internal", "system", "script"}
+	ftpCommands      = []FtpCommand{List, Mkd, Cwd, Pwd, Dele, Rmd, Mv, Cp, Chmod, Chown}
+)
+
+// checkTypes is set by SetCheckTypes, as the collector can not be imported from here.
+var checkTypes []string
+
+// capabilities tells Alpacon what this build supports, so that it does not send
+// queries or commands that would fail.
+type capabilities struct {
+	Version            string          `json:"version"`
+	Queries            []string        `json:"queries"`
+	Shells             []string        `json:"shells"`
+	InternalCommands   []string        `json:"internal_commands"`
+	FtpCommands        []FtpCommand    `json:"ftp_commands"`
+	CommitKeys         []string        `json:"commit_keys"`
+	CheckTypes         []string        `json:"check_types"`
+	ScriptInterpreters []string        `json:"script_interpreters"`
+	Features           map[string]bool `json:"features"`
+}
+
+type capabilitiesQuery struct {
+	Query        string       `json:"query"`
+	Capabilities capabilities `json:"capabilities"`
+}
+
+// SetCheckTypes sets the metric check types reported in the capabilities.
+func SetCheckTypes(types []string) {
+	checkTypes = types
+}
+
+func (wc *WebsocketClient) capabilities() capabilities {
+	commitKeys := make([]string, 0, len(commitDefs))
+	for key := range commitDefs {
+		commitKeys = append(commitKeys, key)
+	}
+	sort.Strings(commitKeys)
+
+	internalCommands := make([]string, 0, len(internalCmds))
+	for name := range internalCmds {
+		internalCommands = append(internalCommands, name)
+	}
+	sort.Strings(internalCommands)
+
+	return capabilities{
+		Version:            version.Version,
+		Queries:            supportedQueries,
+		Shells:             supportedShells,
+		InternalCommands:   internalCommands,
+		FtpCommands:        ftpCommands,
+		CommitKeys:         commitKeys,
+		CheckTypes:         checkTypes,
+		ScriptInterpreters: scriptInterpreters,
+		Features: map[string]bool{
+			"compression":      wc.apiSession.CompressionEnabled(),
+			"spool":            config.GlobalSettings.UseSpool,
+			"stream":           true,
+			"output_artifact":  true,
+			"timeout":          true,
+			"cwd":              true,
+			"stdin":            true,
+			"login":            true,
+			"command_signing":  config.GlobalSettings.SigningKey != nil,
+			"signing_enforced": config.GlobalSettings.SigningEnforce,
+			"failover":         len(config.GlobalSettings.Endpoints) > 1,
+			"resource_limits":  cgroupsAvailable(),
+			"jobs":             wc.jobs != nil && wc.jobs.client != nil,
+		},
+	}
+}
+
+// sendCapabilities is called on every connection, as the server may have been upgraded
+// or a different endpoint may have been connected to since the last one.
+func (wc *WebsocketClient) sendCapabilities() {
+	err := wc.WriteJSON(capabilitiesQuery{
+		Query:        "capabilities",
+		Capabilities: wc.capabilities(),
+	})
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to send capabilities.")
+	}
+}
@@ -0,0 +1,39 @@
+package runner
+
+import (
+	"context"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+type cgroupKey struct{}
+
+// withCgroup returns a context whose processes, started by runCmdWithStream or runShell, are placed in cg.
+func withCgroup(ctx context.Context, cg *commandCgroup) context.Context {
+	return context.WithValue(ctx, cgroupKey{}, cg)
+}
+
+// cgroupFromContext returns the cgroup set by withCgroup, or nil if processes are not limited.
+func cgroupFromContext(ctx context.Context) *commandCgroup {
+	cg, _ := ctx.Value(cgroupKey{}).(*commandCgroup)
+	return cg
+}
+
+// startCgroup creates a cgroup with the configured limits, overridden by those of the command,
+// and sets it to cr.ctx. It returns nil if there are no limits to apply.
+func (cr *CommandRunner) startCgroup() (*commandCgroup, error) {
+	limits := config.GlobalSettings.Limits.Override(cr.data.Limits)
+	if limits.IsZero() {
+		return nil, nil
+	}
+
+	cg, err := newCommandCgroup("cmd", limits)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to create a cgroup, running the command without resource limits.")
+		return nil, err
+	}
+	cr.ctx = withCgroup(cr.ctx, cg)
+
+	return cg, nil
+}
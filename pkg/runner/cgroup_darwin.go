@@ -0,0 +1,27 @@
+package runner
+
+import (
+	"errors"
+	"os/exec"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+)
+
+// commandCgroup does nothing on macOS, which does not have cgroups.
+type commandCgroup struct{}
+
+func cgroupsAvailable() bool {
+	return false
+}
+
+func newCommandCgroup(kind string, limits config.Limits) (*commandCgroup, error) {
+	return nil, errors.New("cgroups are not supported on macOS")
+}
+
+func (cg *commandCgroup) apply(cmd *exec.Cmd) {}
+
+func (cg *commandCgroup) report() string {
+	return ""
+}
+
+func (cg *commandCgroup) remove() {}
@@ -0,0 +1,264 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	cgroupMount = "/sys/fs/cgroup"
+	// Once controllers are enabled for its children, a cgroup can not have processes of its own.
+	// alpamon moves itself into this leaf to create the cgroups of commands next to it.
+	agentCgroup = "agent"
+
+	cgroupRemoveRetries = 10
+	cgroupRemoveDelay   = 10 * time.Millisecond
+)
+
+var cgroupControllers = []string{"cpu", "memory", "pids"}
+
+var delegated struct {
+	once sync.Once
+	dir  string
+	err  error
+}
+
+// commandCgroup is a transient cgroup v2 for the processes of a command or a Websh session.
+type commandCgroup struct {
+	path   string
+	fd     int // passed to clone3, so that processes start in the cgroup
+	limits config.Limits
+}
+
+// ownCgroup returns the cgroup alpamon was started in, which systemd delegates with Delegate=yes.
+func ownCgroup() (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupMount, "cgroup.controllers")); err != nil {
+		return "", fmt.Errorf("cgroup v2 is not mounted at %s", cgroupMount)
+	}
+
+	content, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		path, found := strings.CutPrefix(line, "0::")
+		if !found {
+			continue
+		}
+		if path == "/" {
+			return "", errors.New("alpamon is in the root cgroup, run it as a service with Delegate=yes")
+		}
+		dir := filepath.Join(cgroupMount, path)
+		if filepath.Base(dir) == agentCgroup {
+			dir = filepath.Dir(dir)
+		}
+		return dir, nil
+	}
+
+	return "", errors.New("cgroup v2 is not available")
+}
+
+func cgroupsAvailable() bool {
+	_, err := ownCgroup()
+	return err == nil
+}
+
+// delegatedCgroup prepares the cgroup of alpamon to hold the cgroups of commands, once.
+func delegatedCgroup() (string, error) {
+	delegated.once.Do(func() {
+		delegated.dir, delegated.err = delegateCgroup()
+		if delegated.err != nil {
+			log.Warn().Err(delegated.err).Msg("Resource limits are unavailable.")
+		}
+	})
+	return delegated.dir, delegated.err
+}
+
+func delegateCgroup() (string, error) {
+	dir, err := ownCgroup()
+	if err != nil {
+		return "", err
+	}
+
+	leaf := filepath.Join(dir, agentCgroup)
+	err = os.Mkdir(leaf, 0755)
+	if err != nil && !os.IsExist(err) {
+		return "", err
+	}
+
+	// this includes the processes of commands that are already running, which stay unlimited
+	procs, err := os.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return "", err
+	}
+	for _, pid := range strings.Fields(string(procs)) {
+		err = writeCgroupFile(filepath.Join(leaf, "cgroup.procs"), pid)
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			return "", fmt.Errorf("failed to move process %s into %s: %w", pid, leaf, err)
+		}
+	}
+
+	available, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return "", err
+	}
+	var enable []string
+	for _, controller := range cgroupControllers {
+		if slices.Contains(strings.Fields(string(available)), controller) {
+			enable = append(enable, "+"+controller)
+		}
+	}
+	if len(enable) > 0 {
+		err = writeCgroupFile(filepath.Join(dir, "cgroup.subtree_control"), strings.Join(enable, " "))
+		if err != nil {
+			return "", fmt.Errorf("failed to enable controllers: %w", err)
+		}
+	}
+
+	// cgroups of a previous run are left behind by processes that outlived their command
+	for _, kind := range []string{"cmd", "pty"} {
+		stale, _ := filepath.Glob(filepath.Join(dir, kind+"-*"))
+		for _, path := range stale {
+			_ = syscall.Rmdir(path)
+		}
+	}
+
+	log.Debug().Msgf("Commands are run in cgroups under %s.", dir)
+	return dir, nil
+}
+
+// newCommandCgroup creates a cgroup named after kind, with the given limits.
+func newCommandCgroup(kind string, limits config.Limits) (*commandCgroup, error) {
+	dir, err := delegatedCgroup()
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := os.MkdirTemp(dir, kind+"-*")
+	if err != nil {
+		return nil, err
+	}
+	cg := &commandCgroup{path: path, fd: -1, limits: limits}
+
+	for _, file := range []struct{ name, value string }{
+		{"cpu.max", limits.CPUMax},
+		{"memory.max", limits.MemoryMax},
+		{"pids.max", limits.PidsMax},
+	} {
+		if file.value == "" {
+			continue
+		}
+		err = writeCgroupFile(filepath.Join(path, file.name), file.value)
+		if err != nil {
+			cg.remove()
+			return nil, fmt.Errorf("failed to set %s: %w", file.name, err)
+		}
+	}
+
+	cg.fd, err = syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		cg.remove()
+		return nil, err
+	}
+
+	return cg, nil
+}
+
+// apply makes cmd start in the cgroup. It must be called after cmd.SysProcAttr is set.
+func (cg *commandCgroup) apply(cmd *exec.Cmd) {
+	if cg == nil {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = cg.fd
+}
+
+// report describes how the limits affected the processes, empty if they did not.
+func (cg *commandCgroup) report() string {
+	if cg == nil {
+		return ""
+	}
+
+	var notes []string
+	if n := cg.stat("memory.events", "oom_kill"); n > 0 {
+		notes = append(notes, fmt.Sprintf("%d process(es) killed for exceeding memory.max of %s", n, cg.limits.MemoryMax))
+	}
+	if n := cg.stat("pids.events", "max"); n > 0 {
+		notes = append(notes, fmt.Sprintf("%d fork(s) failed for exceeding pids.max of %s", n, cg.limits.PidsMax))
+	}
+	if n := cg.stat("cpu.stat", "nr_throttled"); n > 0 {
+		throttled := time.Duration(cg.stat("cpu.stat", "throttled_usec")) * time.Microsecond
+		notes = append(notes, fmt.Sprintf("throttled %d time(s) for %s by cpu.max of %s", n, throttled.Round(time.Millisecond), cg.limits.CPUMax))
+	}
+	if len(notes) == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("Resource limits: %s.", strings.Join(notes, ", "))
+}
+
+// stat returns the value of key in a flat keyed cgroup file, or 0 if it is not available.
+func (cg *commandCgroup) stat(file, key string) uint64 {
+	content, err := os.ReadFile(filepath.Join(cg.path, file))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			value, _ := strconv.ParseUint(fields[1], 10, 64)
+			return value
+		}
+	}
+	return 0
+}
+
+// remove removes the cgroup once its processes have exited. Processes that outlive the command,
+// like daemons it started, keep the cgroup and its limits. It is removed on the next start of alpamon after they exit.
+func (cg *commandCgroup) remove() {
+	if cg == nil {
+		return
+	}
+	if cg.fd >= 0 {
+		_ = syscall.Close(cg.fd)
+	}
+
+	var err error
+	for i := 0; i < cgroupRemoveRetries; i++ {
+		// exited processes are removed from the cgroup asynchronously
+		if err = syscall.Rmdir(cg.path); !errors.Is(err, syscall.EBUSY) {
+			break
+		}
+		time.Sleep(cgroupRemoveDelay)
+	}
+	if err != nil {
+		log.Debug().Err(err).Msgf("Failed to remove cgroup %s.", cg.path)
+	}
+}
+
+func writeCgroupFile(path, value string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(value)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
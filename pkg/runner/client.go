@@ -2,14 +2,16 @@ package runner
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/alpacanetworks/alpamon/pkg/db/ent"
 	"github.com/alpacanetworks/alpamon/pkg/scheduler"
 	"github.com/alpacanetworks/alpamon/pkg/utils"
 	"github.com/cenkalti/backoff"
@@ -22,6 +24,8 @@ const (
 	maxConnectInterval    = 60 * time.Second
 	ConnectionReadTimeout = 35 * time.Minute
 	maxRetryTimeout       = 3 * 24 * time.Hour
+	// retries are spread by this fraction of the interval so that agents do not reconnect at once
+	connectJitter = 0.5
 
 	eventCommandAckURL = "/api/events/commands/%s/ack/"
 	eventCommandFinURL = "/api/events/commands/%s/fin/"
@@ -29,27 +33,46 @@ const (
 
 type WebsocketClient struct {
 	Conn                 *websocket.Conn
+	writeMu              sync.Mutex         // websocket connections support one concurrent writer
+	connCancel           context.CancelFunc // stops the goroutines of the current connection
+	connMu               sync.Mutex         // guards Conn against reconnect, which is called from other goroutines
 	requestHeader        http.Header
 	apiSession           *scheduler.Session
+	pool                 *commandPool
+	commands             *commandStore
+	jobs                 *jobScheduler
 	RestartChan          chan struct{}
 	ShutDownChan         chan struct{}
 	CollectorRestartChan chan struct{}
 }
 
-func NewWebsocketClient(session *scheduler.Session) *WebsocketClient {
+func NewWebsocketClient(session *scheduler.Session, client *ent.Client) *WebsocketClient {
 	headers := http.Header{
-		"Authorization": {fmt.Sprintf(`id="%s", key="%s"`, config.GlobalSettings.ID, config.GlobalSettings.Key)},
-		"Origin":        {config.GlobalSettings.ServerURL},
+		"Authorization": {authorization()},
+		"Origin":        {config.ActiveEndpoint().ServerURL},
 		"User-Agent":    {utils.GetUserAgent("alpamon")},
 	}
 
-	return &WebsocketClient{
+	commands := newCommandStore(client)
+	commands.recover()
+
+	wc := &WebsocketClient{
 		requestHeader:        headers,
 		apiSession:           session,
+		pool:                 newCommandPool(commandWorkers, commandQueueSize),
+		commands:             commands,
 		RestartChan:          make(chan struct{}),
 		ShutDownChan:         make(chan struct{}),
 		CollectorRestartChan: make(chan struct{}, 1),
 	}
+	wc.jobs = newJobScheduler(client, wc)
+	wc.jobs.start()
+
+	return wc
+}
+
+func authorization() string {
+	return fmt.Sprintf(`id="%s", key="%s"`, config.GlobalSettings.ID, config.ServerKey())
 }
 
 func (wc *WebsocketClient) RunForever(ctx context.Context) {
@@ -97,7 +120,7 @@ func (wc *WebsocketClient) ReadMessage() (messageType int, message []byte, err e
 }
 
 func (wc *WebsocketClient) Connect() {
-	log.Info().Msgf("Connecting to websocket at %s...", config.GlobalSettings.WSPath)
+	log.Info().Msgf("Connecting to websocket at %s...", config.ActiveEndpoint().WSPath)
 
 	ctx, cancel := context.WithTimeout(context.Background(), maxRetryTimeout)
 	defer cancel()
@@ -106,7 +129,7 @@ func (wc *WebsocketClient) Connect() {
 	wsBackoff.InitialInterval = minConnectInterval
 	wsBackoff.MaxInterval = maxConnectInterval
 	wsBackoff.MaxElapsedTime = 0 // No time limit for retries (infinite retry)
-	wsBackoff.RandomizationFactor = 0
+	wsBackoff.RandomizationFactor = connectJitter
 
 	operation := func() error {
 		select {
@@ -114,19 +137,37 @@ func (wc *WebsocketClient) Connect() {
 			log.Error().Msg("Maximum retry duration reached. Shutting down.")
 			return backoff.Permanent(ctx.Err())
 		default:
-			dialer := websocket.Dialer{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: !config.GlobalSettings.SSLVerify,
-				},
+			dialer, err := utils.NewDialer()
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to load TLS or proxy configuration.")
+				return err
 			}
-			conn, _, err := dialer.Dial(config.GlobalSettings.WSPath, wc.requestHeader)
+			// the key may have been rotated since the last connection
+			wc.requestHeader.Set("Authorization", authorization())
+			endpoint := config.ActiveEndpoint()
+			wc.requestHeader.Set("Origin", endpoint.ServerURL)
+			conn, _, err := dialer.Dial(endpoint.WSPath, wc.requestHeader)
 			if err != nil {
 				nextInterval := wsBackoff.NextBackOff()
-				log.Debug().Err(err).Msgf("Failed to connect to %s, will try again in %ds.", config.GlobalSettings.WSPath, int(nextInterval.Seconds()))
+				log.Debug().Err(err).Msgf("Failed to connect to %s, will try again in %ds.", endpoint.WSPath, int(nextInterval.Seconds()))
+				config.EndpointFailed(endpoint.ServerURL)
 				return err
 			}
+			config.EndpointSucceeded(endpoint.ServerURL)
 
+			// before the read loop gets the connection
+			pongs := trackPongs(conn)
+			connCtx, connCancel := context.WithCancel(context.Background())
+			wc.connMu.Lock()
 			wc.Conn = conn
+			wc.connCancel = connCancel
+			wc.connMu.Unlock()
+			backhaulStats.setConnected(true)
+			go wc.heartbeat(conn, pongs)
+			if !config.IsPrimaryActive() {
+				go wc.failback(connCtx, conn)
+			}
+			wc.sendCapabilities()
 			log.Debug().Msg("Backhaul connection established.")
 			return nil
 		}
@@ -147,6 +188,17 @@ func (wc *WebsocketClient) CloseAndReconnect(ctx context.Context) {
 	wc.Connect()
 }
 
+// reconnect makes RunForever connect again, e.g. with a rotated key. Only the read loop may
+// call Close, as it reads from the connection, so the connection is closed under it instead.
+func (wc *WebsocketClient) reconnect() {
+	wc.connMu.Lock()
+	defer wc.connMu.Unlock()
+
+	if wc.Conn != nil {
+		_ = wc.Conn.Close()
+	}
+}
+
 // Cleanly close the websocket connection by sending a close message
 // Do not close quitChan, as the purpose here is to disconnect the WebSocket,
 // not to terminate RunForever.
@@ -154,6 +206,10 @@ func (wc *WebsocketClient) Close() {
 	if wc.Conn == nil {
 		return
 	}
+	backhaulStats.setConnected(false)
+	if wc.connCancel != nil {
+		wc.connCancel()
+	}
 
 	err := wc.Conn.WriteControl(
 		websocket.CloseMessage,
@@ -226,21 +282,71 @@ func (wc *WebsocketClient) CommandRequestHandler(message []byte) {
 			nil,
 			10,
 			time.Time{},
+			0,
 		)
+		// the command is checked before anything is sent back for it
+		err = verifyCommand(content.Command)
+		if err == nil {
+			err = seenSignatures.checkReplay(content.Command)
+		}
+		// Alpacon may deliver a command again after a reconnect, or after a restart
+		// which has cleared the seen signatures
+		if (err == nil || errors.Is(err, errCommandReplayed)) && wc.commands.received(content.Command) {
+			return
+		}
+		if err != nil {
+			log.Warn().Err(err).Msgf("Rejected command %s: %s > %s", content.Command.ID, content.Command.Shell, content.Command.Line)
+			scheduler.Rqueue.Post(fmt.Sprintf(eventCommandFinURL, content.Command.ID),
+				&commandFin{
+					Success: false,
+					Result:  fmt.Sprintf("Command has been rejected: %s.", err),
+				},
+				10,
+				time.Time{},
+				0,
+			)
+			return
+		}
+		wc.commands.start(content.Command)
 		commandRunner := NewCommandRunner(wc, wc.apiSession, content.Command, data)
-		go commandRunner.Run()
+		wc.pool.submit(commandRunner)
+	case "cancel", "quit", "reconnect":
+		err = verifyControl(content.Query, content.Command)
+		if err == nil {
+			err = seenSignatures.checkControlReplay(content.Query, content.Command)
+		}
+		if err != nil {
+			log.Warn().Err(err).Msgf("Rejected %s query.", content.Query)
+			return
+		}
+		wc.controlHandler(content)
+	default:
+		log.Warn().Msgf("Not implemented query: %s.", content.Query)
+	}
+}
+
+// controlHandler runs a verified control query.
+func (wc *WebsocketClient) controlHandler(content Content) {
+	switch content.Query {
+	case "cancel":
+		if runningCommands.cancel(content.Command.ID) {
+			log.Info().Msgf("Cancelled command %s.", content.Command.ID)
+		} else {
+			log.Debug().Msgf("Command %s to cancel is not running.", content.Command.ID)
+		}
 	case "quit":
 		log.Debug().Msgf("Quit requested for reason: %s.", content.Reason)
 		wc.ShutDown()
 	case "reconnect":
 		log.Debug().Msgf("Reconnect requested for reason: %s.", content.Reason)
 		wc.Close()
-	default:
-		log.Warn().Msgf("Not implemented query: %s.", content.Query)
 	}
 }
 
 func (wc *WebsocketClient) WriteJSON(data interface{}) error {
+	wc.writeMu.Lock()
+	defer wc.writeMu.Unlock()
+
 	err := wc.Conn.WriteJSON(data)
 	if err != nil {
 		log.Debug().Err(err).Msgf("Failed to write json data to websocket.")
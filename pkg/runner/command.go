@@ -3,19 +3,21 @@ package runner
 import (
 	"archive/zip"
 	"bytes"
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
@@ -32,6 +34,10 @@ import (
 
 const (
 	fileUploadTimeout = 60 * 10
+
+	// reboot and shutdown are run after the result of the command has been sent
+	delayedCommandDelay   = 1 * time.Second
+	delayedCommandTimeout = 5 * time.Minute
 )
 
 func NewCommandRunner(wsClient *WebsocketClient, apiSession *scheduler.Session, command Command, data CommandData) *CommandRunner {
@@ -40,13 +46,18 @@ func NewCommandRunner(wsClient *WebsocketClient, apiSession *scheduler.Session,
 		name = fmt.Sprintf("CommandRunner-%s", strings.Split(command.ID, "-")[0])
 	}
 
+	ctx, cancel := context.WithCancelCause(context.Background())
+
 	return &CommandRunner{
 		name:       name,
+		ctx:        ctx,
+		cancel:     cancel,
 		command:    command,
 		data:       data,
 		wsClient:   wsClient,
 		apiSession: apiSession,
 		validator:  validator.New(),
+		runDelayed: runDelayed,
 	}
 }
 
@@ -54,47 +65,114 @@ func (cr *CommandRunner) Run() {
 	var exitCode int
 	var result string
 
+	defer runningCommands.remove(cr)
+	defer cr.cancel(nil)
+
 	log.Debug().Msgf("Received command: %s > %s", cr.command.Shell, cr.command.Line)
 
+	if cr.command.Stream && cr.command.ID != "" && cr.apiSession != nil {
+		cr.stream = newOutputStream(cr.apiSession, cr.command.ID)
+	}
+	if cr.command.ID != "" {
+		cr.spill = &outputSpill{}
+		cr.ctx = withOutputSpill(cr.ctx, cr.spill)
+		defer cr.spill.remove()
+	}
+
+	if cr.command.Timeout > 0 {
+		var cancel context.CancelFunc
+		cr.ctx, cancel = context.WithTimeoutCause(cr.ctx, time.Duration(cr.command.Timeout)*time.Second, errCommandTimedOut)
+		defer cancel()
+	}
+
 	start := time.Now()
-	switch cr.command.Shell {
-	case "internal":
-		exitCode, result = cr.handleInternalCmd()
-	case "system":
-		exitCode, result = cr.handleShellCmd(cr.command.Line, cr.command.User, cr.command.Group, cr.command.Env)
-	default:
+	if cr.ctx.Err() != nil {
+		// cancelled while waiting for a worker
+		exitCode = 1
+	} else if err := checkPolicy(cr.command); err != nil {
 		exitCode = 1
-		result = "Invalid command shell argument."
+		result = fmt.Sprintf("Command has been rejected: %s.", err)
+	} else if err = cr.data.Limits.Validate(); err != nil {
+		exitCode = 1
+		result = fmt.Sprintf("Command has been rejected: %s.", err)
+	} else if cr.command.RunAt != "" || cr.command.Cron != "" {
+		exitCode, result = cr.scheduleJob()
+	} else {
+		cg, cgErr := cr.startCgroup()
+		switch cr.command.Shell {
+		case "internal":
+			exitCode, result = cr.handleInternalCmd()
+		case "system":
+			if cr.command.Login {
+				exitCode, result = cr.handleLoginCmd(cr.command.Line, cr.command.User, cr.command.Group, cr.command.Cwd, cr.command.Stdin, cr.command.Env)
+			} else {
+				exitCode, result = cr.handleShellCmd(cr.command.Line, cr.command.User, cr.command.Group, cr.command.Cwd, cr.command.Stdin, cr.command.Env)
+			}
+		case "script":
+			exitCode, result = cr.handleScriptCmd(cr.command.Line, cr.command.User, cr.command.Group, cr.command.Cwd, cr.command.Stdin, cr.command.Env)
+		default:
+			exitCode = 1
+			result = "Invalid command shell argument."
+		}
+		if cgErr != nil {
+			result += fmt.Sprintf("\nResource limits have not been applied: %s.", cgErr)
+		} else if note := cg.report(); note != "" {
+			result += "\n" + note
+		}
+		cg.remove()
 	}
 
-	if cr.command.ID != "" {
-		finURL := fmt.Sprintf(eventCommandFinURL, cr.command.ID)
+	if cr.stream != nil {
+		cr.stream.close()
+	}
 
-		payload := &commandFin{
-			Success:     exitCode == 0,
-			Result:      result,
-			ElapsedTime: time.Since(start).Seconds(),
+	payload := &commandFin{
+		Success:     exitCode == 0,
+		Result:      result,
+		ElapsedTime: time.Since(start).Seconds(),
+	}
+	if errors.Is(context.Cause(cr.ctx), errCommandCancelled) {
+		payload.Success = false
+		payload.Cancelled = true
+		payload.Result += "\nCommand has been cancelled."
+	} else if errors.Is(context.Cause(cr.ctx), errCommandTimedOut) {
+		payload.Success = false
+		payload.TimedOut = true
+		payload.Result += fmt.Sprintf("\nCommand has timed out after %d seconds.", cr.command.Timeout)
+	}
+	if size := cr.spill.outputSize(); size > 0 {
+		payload.Truncated = true
+		payload.OutputSize = size
+		err := cr.spill.upload(cr)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed to upload the output of command %s.", cr.command.ID)
 		}
-		scheduler.Rqueue.Post(finURL, payload, 10, time.Time{})
+		payload.Artifact = err == nil
 	}
+	cr.fin(payload)
 }
 
-func (cr *CommandRunner) handleInternalCmd() (int, string) {
-	args := strings.Fields(cr.command.Line)
-	if len(args) == 0 {
-		return 1, "No command provided"
+func (cr *CommandRunner) fin(payload *commandFin) {
+	if cr.report != nil {
+		cr.report(payload)
+		return
+	}
+	if cr.command.ID == "" {
+		return
 	}
 
-	for i, arg := range args {
-		unquotedArg, err := strconv.Unquote(arg)
-		if err == nil {
-			args[i] = unquotedArg
-		}
+	if cr.wsClient != nil {
+		cr.wsClient.commands.finish(cr.command.ID, payload)
 	}
 
-	var cmd string
-	switch args[0] {
-	case "upgrade":
+	finURL := fmt.Sprintf(eventCommandFinURL, cr.command.ID)
+	scheduler.Rqueue.Post(finURL, payload, 10, time.Time{}, 0)
+}
+
+// internalCmds dispatches the commands of the internal shell, and lists them in the capabilities.
+var internalCmds = map[string]func(cr *CommandRunner, args []string) (int, string){
+	"upgrade": func(cr *CommandRunner, args []string) (int, string) {
+		var cmd string
 		latestVersion := utils.GetLatestVersion()
 
 		if version.Version == latestVersion {
@@ -110,35 +188,47 @@ func (cr *CommandRunner) handleInternalCmd() (int, string) {
 			return 1, fmt.Sprintf("Platform '%s' not supported.", utils.PlatformLike)
 		}
 		log.Debug().Msgf("Upgrading alpamon from %s to %s using command: '%s'...", version.Version, latestVersion, cmd)
-		return cr.handleShellCmd(cmd, "root", "root", nil)
-	case "commit":
+		return cr.handleShellCmd(cmd, "root", "root", "", "", nil)
+	},
+	"commit": func(cr *CommandRunner, args []string) (int, string) {
 		cr.commit()
 		return 0, "Committed system information."
-	case "sync":
+	},
+	"sync": func(cr *CommandRunner, args []string) (int, string) {
 		cr.sync(cr.data.Keys)
 		return 0, "Synchronized system information."
-	case "adduser":
+	},
+	"adduser": func(cr *CommandRunner, args []string) (int, string) {
 		return cr.addUser()
-	case "addgroup":
+	},
+	"addgroup": func(cr *CommandRunner, args []string) (int, string) {
 		return cr.addGroup()
-	case "deluser":
+	},
+	"deluser": func(cr *CommandRunner, args []string) (int, string) {
 		return cr.delUser()
-	case "delgroup":
+	},
+	"delgroup": func(cr *CommandRunner, args []string) (int, string) {
 		return cr.delGroup()
-	case "moduser":
+	},
+	"moduser": func(cr *CommandRunner, args []string) (int, string) {
 		return cr.modUser()
-	case "ping":
+	},
+	"ping": func(cr *CommandRunner, args []string) (int, string) {
 		return 0, time.Now().Format(time.RFC3339)
-	//case "debug":
-	//	TODO : getReporterStats()
-	case "download":
+	},
+	"debug": func(cr *CommandRunner, args []string) (int, string) {
+		return cr.debug()
+	},
+	"download": func(cr *CommandRunner, args []string) (int, string) {
 		return cr.runFileDownload(args[1])
-	case "upload":
+	},
+	"upload": func(cr *CommandRunner, args []string) (int, string) {
 		code, message := cr.runFileUpload(args[1])
 		statFileTransfer(code, DOWNLOAD, message, cr.data)
 
 		return code, message
-	case "openpty":
+	},
+	"openpty": func(cr *CommandRunner, args []string) (int, string) {
 		data := openPtyData{
 			SessionID:     cr.data.SessionID,
 			URL:           cr.data.URL,
@@ -157,7 +247,8 @@ func (cr *CommandRunner) handleInternalCmd() (int, string) {
 		go ptyClient.RunPtyBackground()
 
 		return 0, "Spawned a pty terminal."
-	case "openftp":
+	},
+	"openftp": func(cr *CommandRunner, args []string) (int, string) {
 		data := openFtpData{
 			SessionID:     cr.data.SessionID,
 			URL:           cr.data.URL,
@@ -176,7 +267,8 @@ func (cr *CommandRunner) handleInternalCmd() (int, string) {
 		}
 
 		return 0, "Spawned a ftp terminal."
-	case "resizepty":
+	},
+	"resizepty": func(cr *CommandRunner, args []string) (int, string) {
 		if terminals[cr.data.SessionID] != nil {
 			err := terminals[cr.data.SessionID].resize(cr.data.Rows, cr.data.Cols)
 			if err != nil {
@@ -185,7 +277,8 @@ func (cr *CommandRunner) handleInternalCmd() (int, string) {
 			return 0, fmt.Sprintf("Resized terminal for %s to %dx%d.", cr.data.SessionID, cr.data.Cols, cr.data.Rows)
 		}
 		return 1, "Invalid session ID"
-	case "restart":
+	},
+	"restart": func(cr *CommandRunner, args []string) (int, string) {
 		target := "alpamon"
 		message := "Alpamon will restart in 1 second."
 		if len(args) >= 2 {
@@ -204,26 +297,27 @@ func (cr *CommandRunner) handleInternalCmd() (int, string) {
 		}
 
 		return 0, message
-	case "quit":
+	},
+	"quit": func(cr *CommandRunner, args []string) (int, string) {
 		time.AfterFunc(1*time.Second, func() {
 			cr.wsClient.ShutDown()
 		})
 		return 0, "Alpamon will shutdown in 1 second."
-	case "reboot":
+	},
+	"reboot": func(cr *CommandRunner, args []string) (int, string) {
 		log.Info().Msg("Reboot request received.")
-		time.AfterFunc(1*time.Second, func() {
-			cr.handleShellCmd("reboot", "root", "root", nil)
-		})
+		cr.runDelayed("reboot")
 
 		return 0, "Server will reboot in 1 second"
-	case "shutdown":
+	},
+	"shutdown": func(cr *CommandRunner, args []string) (int, string) {
 		log.Info().Msg("Shutdown request received.")
-		time.AfterFunc(1*time.Second, func() {
-			cr.handleShellCmd("shutdown", "root", "root", nil)
-		})
+		cr.runDelayed("shutdown")
 
 		return 0, "Server will shutdown in 1 second"
-	case "update":
+	},
+	"update": func(cr *CommandRunner, args []string) (int, string) {
+		var cmd string
 		log.Info().Msg("Upgrade system requested.")
 		if utils.PlatformLike == "debian" {
 			cmd = "apt-get update && apt-get upgrade -y && apt-get autoremove -y"
@@ -235,79 +329,161 @@ func (cr *CommandRunner) handleInternalCmd() (int, string) {
 			return 1, fmt.Sprintf("Platform '%s' not supported.", utils.PlatformLike)
 		}
 
-		return cr.handleShellCmd(cmd, "root", "root", nil)
-	case "restartcoll":
+		return cr.handleShellCmd(cmd, "root", "root", "", "", nil)
+	},
+	"restartcoll": func(cr *CommandRunner, args []string) (int, string) {
 		log.Info().Msg("Restart collector.")
 		cr.wsClient.RestartCollector()
 
 		return 0, "Collector will be restarted."
-	case "help":
+	},
+	"rotatekey": func(cr *CommandRunner, args []string) (int, string) {
+		return cr.rotateKey()
+	},
+	"listjobs": func(cr *CommandRunner, args []string) (int, string) {
+		return cr.listJobs()
+	},
+	"canceljob": func(cr *CommandRunner, args []string) (int, string) {
+		if len(args) < 2 {
+			return 1, "Usage: canceljob <job id>"
+		}
+		cancelled, err := cr.wsClient.jobs.cancel(args[1])
+		if err != nil {
+			return 1, fmt.Sprintf("Failed to cancel job %s: %s.", args[1], err)
+		}
+		if !cancelled {
+			return 1, fmt.Sprintf("Job %s is not scheduled.", args[1])
+		}
+		return 0, fmt.Sprintf("Job %s has been cancelled.", args[1])
+	},
+	"help": func(cr *CommandRunner, args []string) (int, string) {
 		helpMessage := `
 		Available commands:
 		package install <package name>: install a system package
 		package uninstall <package name>: remove a system package
 		upgrade: upgrade alpamon
+		debug: show reporter statistics
+		rotatekey: replace the server key with a new one
 		restart: restart alpamon
 		quit: stop alpamon
 		update: update system
 		reboot: reboot system
 		shutdown: shutdown system
+		listjobs: show scheduled jobs
+		canceljob <job id>: cancel a scheduled job
 		`
 		return 0, helpMessage
-	default:
+	},
+}
+
+func (cr *CommandRunner) handleInternalCmd() (int, string) {
+	args := strings.Fields(cr.command.Line)
+	if len(args) == 0 {
+		return 1, "No command provided"
+	}
+
+	for i, arg := range args {
+		unquotedArg, err := strconv.Unquote(arg)
+		if err == nil {
+			args[i] = unquotedArg
+		}
+	}
+
+	handler, ok := internalCmds[args[0]]
+	if !ok {
 		return 1, fmt.Sprintf("Invalid command %s", args[0])
 	}
+
+	return handler(cr, args)
+}
+
+// runDelayed runs a command line as root after delayedCommandDelay. It does not use cr.ctx,
+// which is cancelled as soon as Run returns.
+func runDelayed(line string) {
+	time.AfterFunc(delayedCommandDelay, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), delayedCommandTimeout)
+		defer cancel()
+
+		exitCode, result := runShell(ctx, line, "root", "root", "", "", nil, nil)
+		if exitCode != 0 {
+			log.Error().Msgf("Failed to run '%s': %s", line, result)
+		}
+	})
 }
 
-func (cr *CommandRunner) handleShellCmd(command, user, group string, env map[string]string) (exitCode int, result string) {
-	spl := strings.Fields(command)
-	args := []string{}
-	results := ""
+// scheduleJob stores the command to be run later by the job scheduler, instead of running it.
+func (cr *CommandRunner) scheduleJob() (exitCode int, result string) {
+	if cr.wsClient == nil {
+		return 1, fmt.Sprintf("Failed to schedule the job: %s.", errJobsUnavailable)
+	}
 
+	next, err := cr.wsClient.jobs.add(cr.command)
+	if err != nil {
+		return 1, fmt.Sprintf("Failed to schedule the job: %s.", err)
+	}
+
+	return 0, fmt.Sprintf("Job %s has been scheduled to run at %s.", cr.command.ID, next.Format(time.RFC3339))
+}
+
+// listJobs describes the scheduled jobs, one per line, in the order they run next.
+func (cr *CommandRunner) listJobs() (exitCode int, result string) {
+	jobs, err := cr.wsClient.jobs.list()
+	if err != nil {
+		return 1, fmt.Sprintf("Failed to list jobs: %s.", err)
+	}
+	if len(jobs) == 0 {
+		return 0, "No jobs are scheduled."
+	}
+
+	var b strings.Builder
+	for _, row := range jobs {
+		var cmd Command
+		_ = json.Unmarshal(row.Command, &cmd)
+
+		schedule := "once"
+		if row.Cron != "" {
+			schedule = fmt.Sprintf("cron '%s'", row.Cron)
+		}
+		fmt.Fprintf(&b, "%s next at %s, %s, %d run(s): %s as %s > %s\n",
+			row.JobID, row.NextRunAt.Format(time.RFC3339), schedule, row.Runs, cmd.Shell, cmd.User, cmd.Line)
+	}
+
+	return 0, strings.TrimSuffix(b.String(), "\n")
+}
+
+func (cr *CommandRunner) handleShellCmd(command, user, group, cwd, stdin string, env map[string]string) (exitCode int, result string) {
 	if group == "" {
 		group = user
 	}
 
-	for _, arg := range spl {
-		switch arg {
-		case "&&":
-			exitCode, result = runCmdWithOutput(args, user, group, env, 0)
-			results += result
-			// stop executing if command fails
-			if exitCode != 0 {
-				return exitCode, results
-			}
-			args = []string{}
-		case "||":
-			exitCode, result = runCmdWithOutput(args, user, group, env, 0)
-			results += result
-			// execute next only if command fails
-			if exitCode == 0 {
-				return exitCode, results
-			}
-			args = []string{}
-		case ";":
-			exitCode, result = runCmdWithOutput(args, user, group, env, 0)
-			results += result
-			args = []string{}
-		default:
-			if strings.HasSuffix(arg, ";") {
-				args = append(args, strings.TrimSuffix(arg, ";"))
-				exitCode, result = runCmdWithOutput(args, user, group, env, 0)
-				results += result
-				args = []string{}
-			} else {
-				args = append(args, arg)
-			}
-		}
+	return runShell(cr.ctx, command, user, group, cwd, stdin, env, cr.stream)
+}
+
+func (cr *CommandRunner) handleLoginCmd(command, user, group, cwd, stdin string, env map[string]string) (exitCode int, result string) {
+	if group == "" {
+		group = user
 	}
 
-	if len(args) > 0 {
-		exitCode, result = runCmdWithOutput(args, user, group, env, 0)
-		results += result
+	return runLoginShell(cr.ctx, command, user, group, cwd, stdin, env, cr.stream)
+}
+
+func (cr *CommandRunner) handleScriptCmd(script, user, group, cwd, stdin string, env map[string]string) (exitCode int, result string) {
+	data := scriptData{
+		Interpreter: cr.data.Interpreter,
+	}
+	err := cr.validateData(data)
+	if err != nil {
+		return 1, fmt.Sprintf("script: Not enough information. %s", err.Error())
+	}
+	if !slices.Contains(scriptInterpreters, data.Interpreter) {
+		return 1, fmt.Sprintf("script: Unsupported interpreter '%s'.", data.Interpreter)
 	}
 
-	return exitCode, results
+	if group == "" {
+		group = user
+	}
+
+	return runScript(cr.ctx, script, data.Interpreter, cr.data.Args, user, group, cwd, stdin, env, cr.stream)
 }
 
 func (cr *CommandRunner) commit() {
@@ -318,6 +494,15 @@ func (cr *CommandRunner) sync(keys []string) {
 	syncSystemInfo(cr.wsClient.apiSession, keys)
 }
 
+func (cr *CommandRunner) debug() (exitCode int, result string) {
+	stats, err := json.MarshalIndent(scheduler.GetReporterStats(), "", "  ")
+	if err != nil {
+		return 1, err.Error()
+	}
+
+	return 0, string(stats)
+}
+
 func (cr *CommandRunner) addUser() (exitCode int, result string) {
 	data := addUserData{
 		Username:                cr.data.Username,
@@ -337,6 +522,7 @@ func (cr *CommandRunner) addUser() (exitCode int, result string) {
 
 	if utils.PlatformLike == "debian" {
 		exitCode, result = runCmdWithOutput(
+			cr.ctx,
 			[]string{
 				"/usr/sbin/adduser",
 				"--home", data.HomeDirectory,
@@ -365,6 +551,7 @@ func (cr *CommandRunner) addUser() (exitCode int, result string) {
 
 			// invoke adduser
 			exitCode, result = runCmdWithOutput(
+				cr.ctx,
 				[]string{
 					"/usr/sbin/adduser",
 					data.Username,
@@ -378,6 +565,7 @@ func (cr *CommandRunner) addUser() (exitCode int, result string) {
 		}
 	} else if utils.PlatformLike == "rhel" {
 		exitCode, result = runCmdWithOutput(
+			cr.ctx,
 			[]string{
 				"/usr/sbin/useradd",
 				"--home-dir", data.HomeDirectory,
@@ -403,6 +591,7 @@ func (cr *CommandRunner) addUser() (exitCode int, result string) {
 	}
 
 	exitCode, result = runCmdWithOutput(
+		cr.ctx,
 		[]string{
 			"chmod", data.HomeDirectoryPermission, data.HomeDirectory,
 		},
@@ -429,6 +618,7 @@ func (cr *CommandRunner) addGroup() (exitCode int, result string) {
 
 	if utils.PlatformLike == "debian" {
 		exitCode, result = runCmdWithOutput(
+			cr.ctx,
 			[]string{
 				"/usr/sbin/addgroup",
 				"--gid", strconv.FormatUint(data.GID, 10),
@@ -441,6 +631,7 @@ func (cr *CommandRunner) addGroup() (exitCode int, result string) {
 		}
 	} else if utils.PlatformLike == "rhel" {
 		exitCode, result = runCmdWithOutput(
+			cr.ctx,
 			[]string{
 				"/usr/sbin/groupadd",
 				"--gid", strconv.FormatUint(data.GID, 10),
@@ -471,6 +662,7 @@ func (cr *CommandRunner) delUser() (exitCode int, result string) {
 
 	if utils.PlatformLike == "debian" {
 		exitCode, result = runCmdWithOutput(
+			cr.ctx,
 			[]string{
 				"/usr/sbin/deluser",
 				data.Username,
@@ -482,6 +674,7 @@ func (cr *CommandRunner) delUser() (exitCode int, result string) {
 		}
 	} else if utils.PlatformLike == "rhel" {
 		exitCode, result = runCmdWithOutput(
+			cr.ctx,
 			[]string{
 				"/usr/sbin/userdel",
 				data.Username,
@@ -511,6 +704,7 @@ func (cr *CommandRunner) delGroup() (exitCode int, result string) {
 
 	if utils.PlatformLike == "debian" {
 		exitCode, result = runCmdWithOutput(
+			cr.ctx,
 			[]string{
 				"/usr/sbin/delgroup",
 				data.Groupname,
@@ -522,6 +716,7 @@ func (cr *CommandRunner) delGroup() (exitCode int, result string) {
 		}
 	} else if utils.PlatformLike == "rhel" {
 		exitCode, result = runCmdWithOutput(
+			cr.ctx,
 			[]string{
 				"/usr/sbin/groupdel",
 				data.Groupname,
@@ -552,6 +747,7 @@ func (cr *CommandRunner) modUser() (exitCode int, result string) {
 
 	if utils.PlatformLike == "debian" || utils.PlatformLike == "rhel" {
 		exitCode, result = runCmdWithOutput(
+			cr.ctx,
 			[]string{
 				"/usr/sbin/usermod",
 				"--comment", data.Comment,
@@ -633,7 +829,12 @@ func (cr *CommandRunner) fileUpload(body bytes.Buffer, contentType string) ([]by
 		return utils.Put(cr.data.Content, body, 0)
 	}
 
-	return cr.wsClient.apiSession.MultipartRequest(cr.data.Content, body, contentType, fileUploadTimeout)
+	data := body.Bytes()
+	getBody := func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	return cr.wsClient.apiSession.MultipartRequest(cr.data.Content, getBody, int64(len(data)), contentType, fileUploadTimeout)
 }
 
 func (cr *CommandRunner) runFileDownload(fileName string) (exitCode int, result string) {
@@ -683,7 +884,7 @@ func (cr *CommandRunner) validateData(data interface{}) error {
 }
 
 func (cr *CommandRunner) openFtp(data openFtpData) error {
-	sysProcAttr, err := demoteFtp(data.Username, data.Groupname)
+	sysProcAttr, err := demote(data.Username, data.Groupname)
 	if err != nil {
 		log.Debug().Err(err).Msg("Failed to get demote permission")
 
@@ -697,23 +898,54 @@ func (cr *CommandRunner) openFtp(data openFtpData) error {
 		return fmt.Errorf("openftp: Failed to get executable path. %w", err)
 	}
 
+	ws, err := dialFtp(data.URL)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to connect to ftp websocket")
+
+		return fmt.Errorf("openftp: Failed to connect to ftp websocket. %w", err)
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		_ = ws.Close()
+		log.Debug().Err(err).Msg("Failed to create ftp worker socket")
+
+		return fmt.Errorf("openftp: Failed to create ftp worker socket. %w", err)
+	}
+	relayFile := os.NewFile(uintptr(fds[0]), "ftp-relay")
+	workerFile := os.NewFile(uintptr(fds[1]), "ftp-worker")
+	defer func() { _ = relayFile.Close() }()
+	defer func() { _ = workerFile.Close() }()
+
 	cmd := exec.Command(
 		executable,
 		"ftp",
-		data.URL,
-		config.GlobalSettings.ServerURL,
 		data.HomeDirectory,
 	)
 	cmd.SysProcAttr = sysProcAttr
+	cmd.ExtraFiles = []*os.File{workerFile}
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
 	if err = cmd.Start(); err != nil {
+		_ = ws.Close()
 		log.Debug().Err(err).Msg("Failed to start ftp worker process")
 
 		return fmt.Errorf("openftp: Failed to start ftp worker process. %w", err)
 	}
 
+	relayConn, err := net.FileConn(relayFile)
+	if err != nil {
+		_ = ws.Close()
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("openftp: Failed to relay ftp websocket. %w", err)
+	}
+	go func() {
+		relayFtp(ws, newFtpConn(relayConn))
+		_ = cmd.Wait()
+	}()
+
 	return nil
 }
 
@@ -731,32 +963,22 @@ func getFileData(data CommandData) ([]byte, error) {
 			return nil, fmt.Errorf("failed to create request: %w", err)
 		}
 
-		parsedServerURL, err := url.Parse(config.GlobalSettings.ServerURL)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse url: %w", err)
-		}
+		for _, endpoint := range config.GlobalSettings.Endpoints {
+			parsedServerURL, err := url.Parse(endpoint.ServerURL)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse url: %w", err)
+			}
 
-		if parsedRequestURL.Host == parsedServerURL.Host && parsedRequestURL.Scheme == parsedServerURL.Scheme {
-			req.Header.Set("Authorization", fmt.Sprintf(`id="%s", key="%s"`,
-				config.GlobalSettings.ID, config.GlobalSettings.Key))
+			if parsedRequestURL.Host == parsedServerURL.Host && parsedRequestURL.Scheme == parsedServerURL.Scheme {
+				req.Header.Set("Authorization", authorization())
+			}
 		}
 
 		client := http.Client{}
 
-		tlsConfig := &tls.Config{}
-		if config.GlobalSettings.CaCert != "" {
-			caCertPool := x509.NewCertPool()
-			caCert, err := os.ReadFile(config.GlobalSettings.CaCert)
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to read CA certificate.")
-			}
-			caCertPool.AppendCertsFromPEM(caCert)
-			tlsConfig.RootCAs = caCertPool
-		}
-
-		tlsConfig.InsecureSkipVerify = !config.GlobalSettings.SSLVerify
-		client.Transport = &http.Transport{
-			TLSClientConfig: tlsConfig,
+		client.Transport, err = utils.NewTransport()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS or proxy configuration: %w", err)
 		}
 
 		resp, err := client.Do(req)
@@ -945,5 +1167,5 @@ func statFileTransfer(code int, transferType transferType, message string, data
 		Message: message,
 		Type:    transferType,
 	}
-	scheduler.Rqueue.Post(statURL, payload, 10, time.Time{})
+	scheduler.Rqueue.Post(statURL, payload, 10, time.Time{}, 0)
 }
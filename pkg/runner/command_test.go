@@ -0,0 +1,32 @@
+package runner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelayedCommandOutlivesRun(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("runs as root")
+	}
+
+	marker := filepath.Join(t.TempDir(), "rebooted")
+	cr := NewCommandRunner(nil, nil, Command{Shell: "internal", Line: "reboot"}, CommandData{})
+	var line string
+	cr.runDelayed = func(l string) {
+		line = l
+		runDelayed("touch " + marker)
+	}
+	cr.Run()
+	assert.Error(t, cr.ctx.Err(), "the context of the command should be cancelled once Run returns")
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(marker)
+		return err == nil
+	}, delayedCommandDelay+5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, "reboot", line)
+}
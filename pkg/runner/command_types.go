@@ -1,6 +1,10 @@
 package runner
 
 import (
+	"context"
+	"time"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
 	"github.com/alpacanetworks/alpamon/pkg/scheduler"
 	"gopkg.in/go-playground/validator.v9"
 )
@@ -12,13 +16,25 @@ type Content struct {
 }
 
 type Command struct {
-	ID    string            `json:"id"`
-	Shell string            `json:"shell"`
-	Line  string            `json:"line"`
-	User  string            `json:"user"`
-	Group string            `json:"group"`
-	Env   map[string]string `json:"env"`
-	Data  string            `json:"data,omitempty"`
+	ID     string            `json:"id"`
+	Shell  string            `json:"shell"`
+	Line   string            `json:"line"`
+	User   string            `json:"user"`
+	Group  string            `json:"group"`
+	Env    map[string]string `json:"env"`
+	Data   string            `json:"data,omitempty"`
+	Stream bool              `json:"stream,omitempty"` // send the output to eventCommandProgressURL while running
+
+	Timeout int    `json:"timeout,omitempty"` // seconds until the command is killed, 0 for no timeout
+	Cwd     string `json:"cwd,omitempty"`     // working directory of system commands, relative to the home directory
+	Stdin   string `json:"stdin,omitempty"`   // standard input of system commands
+	Login   bool   `json:"login,omitempty"`   // run system commands with the login shell and environment of the user
+
+	RunAt string `json:"run_at,omitempty"` // RFC 3339 time to run the command at, as a job of the local scheduler
+	Cron  string `json:"cron,omitempty"`   // cron expression to run the command on, as a job of the local scheduler
+
+	Timestamp string `json:"timestamp,omitempty"` // RFC 3339 time of signing
+	Signature string `json:"signature,omitempty"` // base64 Ed25519 signature of signedMessage
 }
 
 type File struct {
@@ -33,37 +49,46 @@ type File struct {
 }
 
 type CommandData struct {
-	SessionID               string   `json:"session_id"`
-	URL                     string   `json:"url"`
-	Rows                    uint16   `json:"rows"`
-	Cols                    uint16   `json:"cols"`
-	Username                string   `json:"username"`
-	Groupname               string   `json:"groupname"`
-	HomeDirectory           string   `json:"home_directory"`
-	HomeDirectoryPermission string   `json:"home_directory_permission"`
-	UID                     uint64   `json:"uid"`
-	GID                     uint64   `json:"gid"`
-	Comment                 string   `json:"comment"`
-	Shell                   string   `json:"shell"`
-	Groups                  []uint64 `json:"groups"`
-	Type                    string   `json:"type"`
-	Content                 string   `json:"content"`
-	Path                    string   `json:"path"`
-	Paths                   []string `json:"paths"`
-	Files                   []File   `json:"files,omitempty"`
-	AllowOverwrite          bool     `json:"allow_overwrite,omitempty"`
-	AllowUnzip              bool     `json:"allow_unzip,omitempty"`
-	UseBlob                 bool     `json:"use_blob,omitempty"`
-	Keys                    []string `json:"keys"`
+	SessionID               string        `json:"session_id"`
+	URL                     string        `json:"url"`
+	Rows                    uint16        `json:"rows"`
+	Cols                    uint16        `json:"cols"`
+	Username                string        `json:"username"`
+	Groupname               string        `json:"groupname"`
+	HomeDirectory           string        `json:"home_directory"`
+	HomeDirectoryPermission string        `json:"home_directory_permission"`
+	UID                     uint64        `json:"uid"`
+	GID                     uint64        `json:"gid"`
+	Comment                 string        `json:"comment"`
+	Shell                   string        `json:"shell"`
+	Groups                  []uint64      `json:"groups"`
+	Type                    string        `json:"type"`
+	Content                 string        `json:"content"`
+	Path                    string        `json:"path"`
+	Paths                   []string      `json:"paths"`
+	Files                   []File        `json:"files,omitempty"`
+	AllowOverwrite          bool          `json:"allow_overwrite,omitempty"`
+	AllowUnzip              bool          `json:"allow_unzip,omitempty"`
+	UseBlob                 bool          `json:"use_blob,omitempty"`
+	Keys                    []string      `json:"keys"`
+	Limits                  config.Limits `json:"limits"` // overrides the configured resource limits
+	Interpreter             string        `json:"interpreter"`
+	Args                    []string      `json:"args"`
 }
 
 type CommandRunner struct {
 	name       string
+	ctx        context.Context
+	cancel     context.CancelCauseFunc
+	stream     *outputStream // nil unless the output is streamed
+	spill      *outputSpill  // full output of the command, if truncated in the result
 	command    Command
 	wsClient   *WebsocketClient
 	apiSession *scheduler.Session
 	data       CommandData
 	validator  *validator.Validate
+	report     func(*commandFin) // called with the fin instead of sending it, for the runs of jobs
+	runDelayed func(line string) // runs reboot and shutdown after the result has been sent
 }
 
 // Structs defining the required input data for command validation purposes. //
@@ -97,6 +122,10 @@ type modUserData struct {
 	Comment  string `validate:"required"`
 }
 
+type scriptData struct {
+	Interpreter string `validate:"required"`
+}
+
 type openPtyData struct {
 	SessionID     string `validate:"required"`
 	URL           string `validate:"required"`
@@ -119,6 +148,19 @@ type commandFin struct {
 	Success     bool    `json:"success"`
 	Result      string  `json:"result"`
 	ElapsedTime float64 `json:"elapsed_time"`
+	Cancelled   bool    `json:"cancelled,omitempty"`
+	TimedOut    bool    `json:"timed_out,omitempty"`
+	Truncated   bool    `json:"truncated,omitempty"`   // the result only holds the head and tail of the output
+	OutputSize  int64   `json:"output_size,omitempty"` // size of the truncated output
+	Artifact    bool    `json:"artifact,omitempty"`    // the full output has been uploaded to eventCommandOutputURL
+}
+
+type commandProgress struct {
+	Seq       int       `json:"seq"`
+	Stream    string    `json:"stream"`
+	Data      string    `json:"data"`
+	Timestamp time.Time `json:"timestamp"`
+	Truncated bool      `json:"truncated,omitempty"` // chunks before this one have been dropped
 }
 
 type commandStat struct {
@@ -150,3 +192,7 @@ var nonZipExt = map[string]bool{
 	".nupkg": true,
 	".kmz":   true,
 }
+
+type rotateKeyResponse struct {
+	Key string `json:"key"`
+}
@@ -73,11 +73,11 @@ func commitSystemInfo() {
 
 	data := collectData()
 
-	scheduler.Rqueue.Put(commitURL, data, 80, time.Time{})
+	scheduler.Rqueue.Put(commitURL, data, 80, time.Time{}, 0)
 	scheduler.Rqueue.Post(eventURL, []byte(fmt.Sprintf(`{
 		"reporter": "alpamon",
 		"record": "committed", 
-		"description": "Committed system information. version: %s"}`, version.Version)), 80, time.Time{})
+		"description": "Committed system information. version: %s"}`, version.Version)), 80, time.Time{}, 0)
 
 	log.Info().Msg("Completed committing system information.")
 }
@@ -113,7 +113,7 @@ func syncSystemInfo(session *scheduler.Session, keys []string) {
 				Version: version.Version,
 				Load:    loadAvg,
 			}
-			scheduler.Rqueue.Patch(utils.JoinPath(entry.URL, entry.URLSuffix), currentData, 80, time.Time{})
+			scheduler.Rqueue.Patch(utils.JoinPath(entry.URL, entry.URLSuffix), currentData, 80, time.Time{}, 0)
 			continue
 		case "info":
 			if currentData, err = getSystemData(); err != nil {
@@ -204,9 +204,9 @@ func compareData(entry commitDef, currentData, remoteData ComparableData) {
 		}
 	}
 	if createData != nil {
-		scheduler.Rqueue.Post(entry.URL, createData, 80, time.Time{})
+		scheduler.Rqueue.Post(entry.URL, createData, 80, time.Time{}, 0)
 	} else if updateData != nil {
-		scheduler.Rqueue.Patch(entry.URL+remoteData.GetID()+"/", updateData, 80, time.Time{})
+		scheduler.Rqueue.Patch(entry.URL+remoteData.GetID()+"/", updateData, 80, time.Time{}, 0)
 	}
 }
 
@@ -219,11 +219,11 @@ func compareListData[T ComparableData](entry commitDef, currentData, remoteData
 	for _, remoteItem := range remoteData {
 		if currentItem, exists := currentMap[remoteItem.GetKey()]; exists {
 			if !cmp.Equal(currentItem, remoteItem.GetData()) {
-				scheduler.Rqueue.Patch(entry.URL+remoteItem.GetID()+"/", currentItem.GetData(), 80, time.Time{})
+				scheduler.Rqueue.Patch(entry.URL+remoteItem.GetID()+"/", currentItem.GetData(), 80, time.Time{}, 0)
 			}
 			delete(currentMap, currentItem.GetKey())
 		} else {
-			scheduler.Rqueue.Delete(entry.URL+remoteItem.GetID()+"/", nil, 80, time.Time{})
+			scheduler.Rqueue.Delete(entry.URL+remoteItem.GetID()+"/", nil, 80, time.Time{}, 0)
 		}
 	}
 
@@ -232,7 +232,7 @@ func compareListData[T ComparableData](entry commitDef, currentData, remoteData
 		createData = append(createData, currentItem.GetData())
 	}
 	if len(createData) > 0 {
-		scheduler.Rqueue.Post(entry.URL, createData, 80, time.Time{})
+		scheduler.Rqueue.Post(entry.URL, createData, 80, time.Time{}, 0)
 	}
 }
 
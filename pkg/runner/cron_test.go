@@ -0,0 +1,49 @@
+package runner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronNext(t *testing.T) {
+	// a friday
+	now := time.Date(2025, time.April, 18, 10, 30, 15, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2025, time.April, 18, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, time.April, 18, 10, 45, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2025, time.April, 19, 3, 0, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2025, time.April, 19, 10, 30, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", time.Date(2025, time.April, 21, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2025, time.April, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"5/20 8-9 * * *", time.Date(2025, time.April, 19, 8, 5, 0, 0, time.UTC)},
+		{"0 12 1,15 * *", time.Date(2025, time.May, 1, 12, 0, 0, 0, time.UTC)},
+		// either day matches if both are restricted
+		{"0 0 1 * sun", time.Date(2025, time.April, 20, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2025, time.April, 18, 11, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		schedule, err := parseCron(tt.expr)
+		if assert.NoError(t, err, tt.expr) {
+			assert.Equal(t, tt.want, schedule.next(now), tt.expr)
+		}
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *",
+		"* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "* * * foo *",
+	} {
+		_, err := parseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
@@ -0,0 +1,51 @@
+package runner
+
+import (
+	"context"
+	"time"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	failbackInterval = 60 * time.Second
+	// the primary must pass this many probes in a row, so that a flapping primary is not used
+	failbackProbes = 3
+)
+
+// failback probes the primary endpoint while connected to another one.
+// Once the primary is healthy, it becomes active again and the connection is closed,
+// so that RunForever reconnects to the primary. Websh and FTP channels that are open
+// stay on their endpoint until they are closed.
+func (wc *WebsocketClient) failback(ctx context.Context, conn *websocket.Conn) {
+	primary := config.GlobalSettings.Endpoints[0].ServerURL
+
+	ticker := time.NewTicker(failbackInterval)
+	defer ticker.Stop()
+
+	healthy := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := wc.apiSession.Probe(primary)
+			if err != nil {
+				log.Debug().Err(err).Msgf("Primary endpoint %s is still unavailable.", primary)
+				healthy = 0
+				continue
+			}
+
+			healthy++
+			if healthy < failbackProbes {
+				continue
+			}
+
+			config.FailBack()
+			_ = conn.Close()
+			return
+		}
+	}
+}
@@ -1,60 +1,180 @@
 package runner
 
 import (
+	"bufio"
 	"context"
-	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/alpacanetworks/alpamon/pkg/config"
 	"github.com/alpacanetworks/alpamon/pkg/logger"
 	"github.com/alpacanetworks/alpamon/pkg/utils"
 	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// The ftp worker runs as the demoted user, so it is not given the credentials of alpamon to connect
+// to Alpacon: its client key, or the password of the proxy. alpamon connects the websocket instead,
+// and relays its messages to the worker over a socket passed as ftpWorkerFd.
+const (
+	ftpWorkerFd = 3 // the first of cmd.ExtraFiles
+
+	// messages between alpamon and the ftp worker are prefixed with their length
+	maxFtpMessageSize = 64 * 1024 * 1024
 )
 
 type FtpClient struct {
-	conn             *websocket.Conn
-	requestHeader    http.Header
-	url              string
+	conn             *ftpConn
 	homeDirectory    string
 	workingDirectory string
 	log              logger.FtpLogger
 }
 
 func NewFtpClient(data FtpConfigData) *FtpClient {
-	headers := http.Header{
-		"Origin":     {data.ServerURL},
-		"User-Agent": {utils.GetUserAgent("alpamon")},
-	}
-
 	return &FtpClient{
-		requestHeader:    headers,
-		url:              strings.Replace(data.ServerURL, "http", "ws", 1) + data.URL,
+		conn:             newFtpConn(data.Conn),
 		homeDirectory:    data.HomeDirectory,
 		workingDirectory: data.HomeDirectory,
 		log:              data.Logger,
 	}
 }
 
-func (fc *FtpClient) RunFtpBackground() {
-	fc.log.Debug().Msg("Opening websocket for ftp session.")
+// OpenFtpWorkerConn returns the connection to alpamon passed to the ftp worker.
+func OpenFtpWorkerConn() (net.Conn, error) {
+	file := os.NewFile(ftpWorkerFd, "ftp")
+	defer func() { _ = file.Close() }()
 
-	var err error
-	dialer := websocket.Dialer{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: !config.GlobalSettings.SSLVerify,
-		},
+	return net.FileConn(file)
+}
+
+// ftpConn passes messages over a stream connection between alpamon and the ftp worker.
+type ftpConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+}
+
+func newFtpConn(conn net.Conn) *ftpConn {
+	return &ftpConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+func (c *ftpConn) ReadMessage() ([]byte, error) {
+	var size uint32
+	err := binary.Read(c.reader, binary.BigEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxFtpMessageSize {
+		return nil, fmt.Errorf("ftp message of %d bytes is too large", size)
+	}
+
+	message := make([]byte, size)
+	_, err = io.ReadFull(c.reader, message)
+	if err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+func (c *ftpConn) WriteMessage(message []byte) error {
+	if len(message) > maxFtpMessageSize {
+		return fmt.Errorf("ftp message of %d bytes is too large", len(message))
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	header := binary.BigEndian.AppendUint32(nil, uint32(len(message)))
+	buffers := net.Buffers{header, message}
+	_, err := buffers.WriteTo(c.conn)
+
+	return err
+}
+
+func (c *ftpConn) Close() error {
+	return c.conn.Close()
+}
+
+// dialFtp connects the websocket of an ftp session to Alpacon, with the TLS and proxy settings of alpamon.
+func dialFtp(url string) (*websocket.Conn, error) {
+	dialer, err := utils.NewDialer()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := config.ActiveEndpoint()
+	headers := http.Header{
+		"Origin":     {endpoint.ServerURL},
+		"User-Agent": {utils.GetUserAgent("alpamon")},
 	}
-	fc.conn, _, err = dialer.Dial(fc.url, fc.requestHeader)
+	conn, _, err := dialer.Dial(strings.Replace(endpoint.ServerURL, "http", "ws", 1)+url, headers)
 	if err != nil {
-		fc.log.Debug().Err(err).Msgf("Failed to connect to pty websocket at %s.", fc.url)
-		return
+		return nil, err
 	}
+
+	return conn, nil
+}
+
+// relayFtp passes the messages between the websocket and the ftp worker until either of them is closed.
+func relayFtp(ws *websocket.Conn, worker *ftpConn) {
+	var once sync.Once
+	closeAll := func() {
+		once.Do(func() {
+			_ = ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(time.Second))
+			_ = ws.Close()
+			_ = worker.Close()
+		})
+	}
+
+	go func() {
+		defer closeAll()
+		for {
+			message, err := worker.ReadMessage()
+			if err != nil {
+				return
+			}
+			err = ws.WriteMessage(websocket.TextMessage, message)
+			if err != nil {
+				log.Debug().Err(err).Msg("Failed to send ftp message to Alpacon.")
+				return
+			}
+		}
+	}()
+
+	defer closeAll()
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Debug().Err(err).Msg("Failed to read from ftp websocket.")
+			}
+			return
+		}
+		err = worker.WriteMessage(message)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (fc *FtpClient) RunFtpBackground() {
+	fc.log.Debug().Msg("Serving ftp session.")
 	defer fc.close()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -71,13 +191,14 @@ func (fc *FtpClient) read(ctx context.Context, cancel context.CancelFunc) {
 		case <-ctx.Done():
 			return
 		default:
-			_, message, err := fc.conn.ReadMessage()
+			message, err := fc.conn.ReadMessage()
 			if err != nil {
 				if ctx.Err() != nil {
 					return
 				}
-				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-					fc.log.Debug().Err(err).Msg("Failed to read from ftp websocket.")
+				// alpamon closes the connection once the websocket is closed
+				if !errors.Is(err, io.EOF) {
+					fc.log.Debug().Err(err).Msg("Failed to read from ftp connection.")
 				}
 				cancel()
 				return
@@ -115,14 +236,12 @@ func (fc *FtpClient) read(ctx context.Context, cancel context.CancelFunc) {
 				return
 			}
 
-			err = fc.conn.WriteMessage(websocket.TextMessage, response)
+			err = fc.conn.WriteMessage(response)
 			if err != nil {
 				if ctx.Err() != nil {
 					return
 				}
-				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-					fc.log.Debug().Err(err).Msg("Failed to send websocket message.")
-				}
+				fc.log.Debug().Err(err).Msg("Failed to send ftp message.")
 				cancel()
 				return
 			}
@@ -132,11 +251,10 @@ func (fc *FtpClient) read(ctx context.Context, cancel context.CancelFunc) {
 
 func (fc *FtpClient) close() {
 	if fc.conn != nil {
-		_ = fc.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 		_ = fc.conn.Close()
 	}
 
-	fc.log.Debug().Msg("Websocket connection for ftp has been closed.")
+	fc.log.Debug().Msg("Connection for ftp has been closed.")
 	os.Exit(1)
 }
 
@@ -0,0 +1,84 @@
+package runner
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelayFtp(t *testing.T) {
+	received := make(chan string, 1)
+	closed := make(chan error, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"command": "pwd"}`))
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			closed <- err
+			return
+		}
+		received <- string(message)
+		_, _, err = conn.ReadMessage()
+		closed <- err
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	relayConn, workerConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		relayFtp(ws, newFtpConn(relayConn))
+		close(done)
+	}()
+
+	// the worker only sees the messages, not the websocket
+	worker := newFtpConn(workerConn)
+	message, err := worker.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, `{"command": "pwd"}`, string(message))
+
+	require.NoError(t, worker.WriteMessage([]byte(`{"success": true}`)))
+	select {
+	case message := <-received:
+		assert.Equal(t, `{"success": true}`, message)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the message of the worker was not relayed")
+	}
+
+	// the websocket is closed once the worker exits
+	require.NoError(t, worker.Close())
+	select {
+	case err := <-closed:
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the websocket was not closed")
+	}
+	<-done
+}
+
+func TestFtpConnMessageSize(t *testing.T) {
+	a, b := net.Pipe()
+	defer func() { _ = a.Close() }()
+	defer func() { _ = b.Close() }()
+
+	go func() {
+		_, _ = a.Write(binary.BigEndian.AppendUint32(nil, maxFtpMessageSize+1))
+	}()
+	_, err := newFtpConn(b).ReadMessage()
+	assert.ErrorContains(t, err, "too large")
+}
@@ -1,6 +1,7 @@
 package runner
 
 import (
+	"net"
 	"strings"
 	"time"
 
@@ -33,10 +34,9 @@ const (
 )
 
 type FtpConfigData struct {
-	URL           string
-	ServerURL     string
 	HomeDirectory string
 	Logger        logger.FtpLogger
+	Conn          net.Conn // to alpamon, which relays the messages of the websocket
 }
 
 type FtpData struct {
@@ -0,0 +1,136 @@
+package runner
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// The backhaul is considered dead after this many pings without a pong.
+const maxMissedPongs = 3
+
+// ConnectionStats describes the quality of the backhaul connection.
+type ConnectionStats struct {
+	Connected     bool       `json:"connected"`
+	RTT           float64    `json:"rtt"` // seconds, averaged over recent pongs
+	Reconnects    int        `json:"reconnects"`
+	LastConnected *time.Time `json:"last_connected"`
+}
+
+type connectionStats struct {
+	mu            sync.Mutex
+	connected     bool
+	rtt           float64
+	connects      int
+	lastConnected time.Time
+}
+
+var backhaulStats = &connectionStats{}
+
+// GetConnectionStats returns the quality of the backhaul connection.
+func GetConnectionStats() ConnectionStats {
+	backhaulStats.mu.Lock()
+	defer backhaulStats.mu.Unlock()
+
+	stats := ConnectionStats{
+		Connected: backhaulStats.connected,
+		RTT:       backhaulStats.rtt,
+	}
+	if backhaulStats.connects > 1 {
+		stats.Reconnects = backhaulStats.connects - 1
+	}
+	if !backhaulStats.lastConnected.IsZero() {
+		lastConnected := backhaulStats.lastConnected
+		stats.LastConnected = &lastConnected
+	}
+
+	return stats
+}
+
+func (cs *connectionStats) setConnected(connected bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.connected = connected
+	if connected {
+		cs.connects++
+		cs.lastConnected = time.Now()
+	}
+}
+
+func (cs *connectionStats) updateRTT(rtt time.Duration) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.rtt == 0 {
+		cs.rtt = rtt.Seconds()
+	} else {
+		cs.rtt = cs.rtt*0.9 + rtt.Seconds()*0.1
+	}
+}
+
+// pongTracker records when the last pong of a connection was received.
+type pongTracker struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+// trackPongs sets the pong handler of conn. It must be called before the connection is read,
+// as the handler can not be set while another goroutine reads from it.
+// Each pong echoes the send time of its ping, which is used to measure the round-trip time.
+func trackPongs(conn *websocket.Conn) *pongTracker {
+	pongs := &pongTracker{last: time.Now()}
+	conn.SetPongHandler(func(appData string) error {
+		pongs.mu.Lock()
+		pongs.last = time.Now()
+		pongs.mu.Unlock()
+
+		sent, err := strconv.ParseInt(appData, 10, 64)
+		if err == nil {
+			backhaulStats.updateRTT(time.Since(time.Unix(0, sent)))
+		}
+		return nil
+	})
+
+	return pongs
+}
+
+func (p *pongTracker) since() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return time.Since(p.last)
+}
+
+// heartbeat pings the backhaul until it is closed, and closes it after maxMissedPongs missed pongs
+// so that RunForever reconnects instead of waiting for ConnectionReadTimeout.
+// Each ping carries its send time for the pong handler set by trackPongs.
+func (wc *WebsocketClient) heartbeat(conn *websocket.Conn, pongs *pongTracker) {
+	interval := config.GlobalSettings.PingInterval
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if pongs.since() > interval*maxMissedPongs {
+			log.Warn().Msgf("No pong from the backhaul in %s, reconnecting.", interval*maxMissedPongs)
+			_ = conn.Close()
+			return
+		}
+
+		payload := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+		err := conn.WriteControl(websocket.PingMessage, payload, time.Now().Add(interval))
+		if err != nil {
+			// the connection has been closed or replaced
+			log.Debug().Err(err).Msg("Stopped pinging the backhaul.")
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package runner
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPongServer starts a websocket server which answers pings while pong is true.
+func newPongServer(t *testing.T, pong *atomic.Bool) string {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		conn.SetPingHandler(func(appData string) error {
+			if !pong.Load() {
+				return nil
+			}
+			return conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(time.Second))
+		})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestHeartbeat(t *testing.T) {
+	defer func(interval time.Duration) { config.GlobalSettings.PingInterval = interval }(config.GlobalSettings.PingInterval)
+	config.GlobalSettings.PingInterval = 20 * time.Millisecond
+
+	var pong atomic.Bool
+	pong.Store(true)
+	conn, _, err := websocket.DefaultDialer.Dial(newPongServer(t, &pong), nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	// as in Connect, pongs are tracked before the connection is read
+	pongs := trackPongs(conn)
+	wc := &WebsocketClient{}
+	stopped := make(chan struct{})
+	go func() {
+		wc.heartbeat(conn, pongs)
+		close(stopped)
+	}()
+	closed := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	// pongs are received while the read loop runs, and measure the round-trip time
+	time.Sleep(10 * config.GlobalSettings.PingInterval)
+	assert.Less(t, pongs.since(), 5*config.GlobalSettings.PingInterval)
+	assert.Positive(t, GetConnectionStats().RTT)
+	assert.Empty(t, stopped)
+
+	// the connection is closed once the pongs stop
+	pong.Store(false)
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the heartbeat did not stop without pongs")
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the connection was not closed without pongs")
+	}
+}
@@ -0,0 +1,270 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alpacanetworks/alpamon/pkg/db/ent"
+	"github.com/alpacanetworks/alpamon/pkg/db/ent/job"
+	"github.com/alpacanetworks/alpamon/pkg/scheduler"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	eventJobRunURL = "/api/events/jobs/%s/runs/"
+
+	// due jobs are looked up at least this often, in case the clock has been changed
+	jobPollInterval = time.Minute
+	// finished and cancelled jobs are removed after this long
+	jobRetention = 7 * 24 * time.Hour
+)
+
+var errJobsUnavailable = errors.New("jobs require the local database")
+
+// jobScheduler runs commands at a given time or on a cron schedule. Jobs are kept in the local
+// database, so that they run while Alpacon is unreachable and after a restart of alpamon.
+// The results of their runs are queued to be sent once Alpacon is reachable.
+type jobScheduler struct {
+	client *ent.Client
+	wc     *WebsocketClient
+	wake   chan struct{}
+}
+
+// jobRun is the result of a run of a job, sent to eventJobRunURL.
+type jobRun struct {
+	*commandFin
+	Run         int       `json:"run"` // the runs of a job are numbered from 1
+	ScheduledAt time.Time `json:"scheduled_at"`
+}
+
+func newJobScheduler(client *ent.Client, wc *WebsocketClient) *jobScheduler {
+	return &jobScheduler{
+		client: client,
+		wc:     wc,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// start removes old jobs and runs the scheduled ones in the background.
+// Runs missed while alpamon was stopped are run once, right away.
+func (s *jobScheduler) start() {
+	if s.client == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	_, err := s.client.Job.Delete().
+		Where(
+			job.StateNEQ(job.StateScheduled),
+			job.CreatedAtLT(time.Now().Add(-jobRetention)),
+		).
+		Exec(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to delete old jobs.")
+	}
+
+	go s.run()
+}
+
+// add schedules the command to run at cmd.RunAt or on cmd.Cron, with the command ID as the job ID.
+// It returns the time of the first run.
+func (s *jobScheduler) add(cmd Command) (time.Time, error) {
+	if s == nil || s.client == nil {
+		return time.Time{}, errJobsUnavailable
+	}
+
+	next, err := firstJobRun(cmd, time.Now())
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	content, err := json.Marshal(cmd)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	err = s.client.Job.Create().
+		SetJobID(cmd.ID).
+		SetCommand(content).
+		SetCron(cmd.Cron).
+		SetState(job.StateScheduled).
+		SetNextRunAt(next).
+		SetCreatedAt(time.Now()).
+		Exec(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return next, nil
+}
+
+// firstJobRun returns when a job is first run. A time in the past runs it right away.
+func firstJobRun(cmd Command, now time.Time) (time.Time, error) {
+	if cmd.ID == "" {
+		return time.Time{}, errors.New("a job requires a command ID")
+	}
+	if cmd.RunAt != "" && cmd.Cron != "" {
+		return time.Time{}, errors.New("run_at and cron can not be used together")
+	}
+
+	if cmd.RunAt != "" {
+		runAt, err := time.Parse(time.RFC3339, cmd.RunAt)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid run_at: %w", err)
+		}
+		return runAt, nil
+	}
+
+	schedule, err := parseCron(cmd.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := schedule.next(now)
+	if next.IsZero() {
+		return time.Time{}, fmt.Errorf("cron expression %q never matches", cmd.Cron)
+	}
+
+	return next, nil
+}
+
+// cancel stops future runs of the job. A run in progress is not affected.
+// It returns false if the job is not scheduled.
+func (s *jobScheduler) cancel(id string) (bool, error) {
+	if s == nil || s.client == nil {
+		return false, errJobsUnavailable
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	n, err := s.client.Job.Update().
+		Where(job.JobID(id), job.StateEQ(job.StateScheduled)).
+		SetState(job.StateCancelled).
+		Save(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// list returns the scheduled jobs, in the order they run next.
+func (s *jobScheduler) list() ([]*ent.Job, error) {
+	if s == nil || s.client == nil {
+		return nil, errJobsUnavailable
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	return s.client.Job.Query().
+		Where(job.StateEQ(job.StateScheduled)).
+		Order(ent.Asc(job.FieldNextRunAt)).
+		All(ctx)
+}
+
+func (s *jobScheduler) run() {
+	for {
+		timer := time.NewTimer(s.runDue())
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// runDue runs the jobs that are due and returns how long to wait for the next one.
+func (s *jobScheduler) runDue() time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	now := time.Now()
+	rows, err := s.client.Job.Query().
+		Where(job.StateEQ(job.StateScheduled), job.NextRunAtLTE(now)).
+		All(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to look up due jobs.")
+		return jobPollInterval
+	}
+	for _, row := range rows {
+		s.runJob(ctx, row, now)
+	}
+
+	wait := jobPollInterval
+	next, err := s.client.Job.Query().
+		Where(job.StateEQ(job.StateScheduled)).
+		Order(ent.Asc(job.FieldNextRunAt)).
+		First(ctx)
+	if err == nil {
+		wait = min(wait, time.Until(next.NextRunAt))
+	}
+
+	return max(wait, time.Second)
+}
+
+// runJob records the run before starting it, so that a run interrupted by a restart is not repeated.
+func (s *jobScheduler) runJob(ctx context.Context, row *ent.Job, now time.Time) {
+	var cmd Command
+	var data CommandData
+	err := json.Unmarshal(row.Command, &cmd)
+	if err == nil && cmd.Data != "" {
+		err = json.Unmarshal([]byte(cmd.Data), &data)
+	}
+
+	update := s.client.Job.UpdateOne(row).
+		SetLastRunAt(now).
+		AddRuns(1)
+	if next := nextJobRun(row.Cron, now); next.IsZero() || err != nil {
+		update.SetState(job.StateFinished)
+	} else {
+		update.SetNextRunAt(next)
+	}
+	if updateErr := update.Exec(ctx); updateErr != nil {
+		log.Error().Err(updateErr).Msgf("Failed to record the run of job %s.", row.JobID)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to read job %s.", row.JobID)
+		return
+	}
+
+	log.Info().Msgf("Running job %s: %s > %s", row.JobID, cmd.Shell, cmd.Line)
+
+	// the run is a command of its own, which is not tracked by Alpacon
+	cmd.ID, cmd.RunAt, cmd.Cron, cmd.Stream = "", "", "", false
+	cr := NewCommandRunner(s.wc, s.wc.apiSession, cmd, data)
+	run := &jobRun{Run: row.Runs + 1, ScheduledAt: row.NextRunAt}
+	cr.report = func(payload *commandFin) {
+		run.commandFin = payload
+		scheduler.Rqueue.Post(fmt.Sprintf(eventJobRunURL, row.JobID), run, 10, time.Time{}, 0)
+	}
+	s.wc.pool.submit(cr)
+}
+
+// nextJobRun returns the next run of a cron job after now, or the zero time if there is none.
+func nextJobRun(cron string, now time.Time) time.Time {
+	if cron == "" {
+		return time.Time{}
+	}
+
+	schedule, err := parseCron(cron)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return schedule.next(now)
+}
@@ -0,0 +1,259 @@
+package runner
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+
+	"github.com/alpacanetworks/alpamon/pkg/utils"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	loginDefsFile   = "/etc/login.defs"
+	pamEnvConfFile  = "/etc/security/pam_env.conf"
+	environmentFile = "/etc/environment"
+
+	defaultLoginShell = "/bin/sh"
+	defaultUserPath   = "/usr/local/bin:/usr/bin:/bin"
+	defaultRootPath   = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// localeFiles are read like /etc/environment, on Debian and RHEL based systems respectively.
+var localeFiles = []string{"/etc/default/locale", "/etc/locale.conf"}
+
+// runLoginShell runs a command line with the login shell of the user, in the environment of a login
+// session and with the supplementary groups of the user, so that it behaves as if the user ran it on a terminal.
+func runLoginShell(ctx context.Context, line, username, groupname, cwd, stdin string, env map[string]string, stream *outputStream) (exitCode int, result string) {
+	usr, err := utils.GetSystemUser(username)
+	if err != nil {
+		return 1, err.Error()
+	}
+	shell := loginShell(usr)
+
+	vars := loginEnv(usr, shell)
+	for key, value := range env {
+		vars[key] = value
+	}
+
+	cmd := exec.CommandContext(ctx, shell, "-l", "-c", line)
+	if username != "root" {
+		sysProcAttr, err := demote(username, groupname)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to demote user.")
+			return -1, err.Error()
+		}
+		cmd.SysProcAttr = sysProcAttr
+	}
+	setProcessGroup(ctx, cmd)
+
+	cmd.Env = environ(vars)
+	cmd.Dir, err = commandDir(usr.HomeDir, cwd)
+	if err != nil {
+		return 1, err.Error()
+	}
+
+	if stdin != "" {
+		file, err := stdinFile(stdin)
+		if err != nil {
+			return 1, err.Error()
+		}
+		defer func() { _ = file.Close() }()
+		cmd.Stdin = file
+	}
+
+	log.Debug().Msgf("Executing login shell %s as user '%s' (group: '%s') -> '%s'", shell, username, groupname, line)
+	return runWithOutput(ctx, cmd, stream)
+}
+
+// loginShell returns the shell of the user in /etc/passwd.
+func loginShell(usr *user.User) string {
+	users, err := getUserData()
+	if err != nil {
+		return defaultLoginShell
+	}
+	for _, u := range users {
+		if u.Username == usr.Username && u.Shell != "" {
+			return u.Shell
+		}
+	}
+
+	return defaultLoginShell
+}
+
+// loginEnv returns the environment login(1) and pam_env(8) set up for a session of the user.
+// Later files override earlier ones, but not the variables set from passwd.
+func loginEnv(usr *user.User, shell string) map[string]string {
+	account := map[string]string{
+		"USER":    usr.Username,
+		"LOGNAME": usr.Username,
+		"HOME":    usr.HomeDir,
+		"SHELL":   shell,
+	}
+
+	env := make(map[string]string)
+	for key, value := range account {
+		env[key] = value
+	}
+	env["PATH"] = loginPath(usr.Uid == "0")
+
+	readPamEnvConf(pamEnvConfFile, env)
+	readEnvFile(environmentFile, env)
+	for _, file := range localeFiles {
+		readEnvFile(file, env)
+	}
+
+	for key, value := range account {
+		env[key] = value
+	}
+
+	return env
+}
+
+// loginPath returns ENV_SUPATH or ENV_PATH of /etc/login.defs.
+func loginPath(root bool) string {
+	name, path := "ENV_PATH", defaultUserPath
+	if root {
+		name, path = "ENV_SUPATH", defaultRootPath
+	}
+
+	file, err := os.Open(loginDefsFile)
+	if err != nil {
+		return path
+	}
+	defer func() { _ = file.Close() }()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == name {
+			return strings.TrimPrefix(fields[1], "PATH=")
+		}
+	}
+
+	return path
+}
+
+// readEnvFile sets the KEY=VALUE lines of file to env, as pam_env reads /etc/environment.
+func readEnvFile(path string, env map[string]string) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer func() { _ = file.Close() }()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || !isName(key) {
+			continue
+		}
+		env[key] = unquoteEnvValue(strings.TrimSpace(value))
+	}
+}
+
+// readPamEnvConf sets the variables of a pam_env.conf file to env. Each line is
+// "VARIABLE [DEFAULT=value] [OVERRIDE=value]", where values can refer to ${VARIABLE}
+// of the environment, and @{HOME} and @{SHELL} of the user.
+func readPamEnvConf(path string, env map[string]string) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(string(content), "\\\n", ""), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, options := line, ""
+		if end := strings.IndexAny(line, " \t"); end >= 0 {
+			name, options = line[:end], line[end:]
+		}
+		if !isName(name) {
+			continue
+		}
+
+		var defaultValue, overrideValue string
+		var hasOverride bool
+		for options = strings.TrimSpace(options); options != ""; options = strings.TrimSpace(options) {
+			var option, value string
+			option, options, _ = strings.Cut(options, "=")
+			value, options = pamEnvValue(options)
+			switch strings.TrimSpace(option) {
+			case "DEFAULT":
+				defaultValue = expandPamEnv(value, env)
+			case "OVERRIDE":
+				overrideValue = expandPamEnv(value, env)
+				hasOverride = true
+			}
+		}
+
+		value := defaultValue
+		if hasOverride && overrideValue != "" {
+			value = overrideValue
+		}
+		if value == "" {
+			delete(env, name)
+		} else {
+			env[name] = value
+		}
+	}
+}
+
+// pamEnvValue splits the value of an option, which is quoted if it contains blanks, from the rest of the line.
+func pamEnvValue(s string) (value, rest string) {
+	if strings.HasPrefix(s, `"`) {
+		if end := strings.Index(s[1:], `"`); end >= 0 {
+			return s[1 : end+1], s[end+2:]
+		}
+		return s[1:], ""
+	}
+	if end := strings.IndexAny(s, " \t"); end >= 0 {
+		return s[:end], s[end:]
+	}
+
+	return s, ""
+}
+
+func expandPamEnv(value string, env map[string]string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == '\\' && i+1 < len(value) {
+			i++
+			b.WriteByte(value[i])
+			continue
+		}
+		if (c == '$' || c == '@') && i+1 < len(value) && value[i+1] == '{' {
+			if end := strings.IndexByte(value[i:], '}'); end >= 0 {
+				// @{HOME} and @{SHELL} are those of passwd, which are set to env before
+				b.WriteString(env[value[i+2:i+end]])
+				i += end
+				continue
+			}
+		}
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+func unquoteEnvValue(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+
+	return value
+}
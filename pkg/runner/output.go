@@ -0,0 +1,236 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/alpacanetworks/alpamon/pkg/utils"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	eventCommandOutputURL = "/api/events/commands/%s/output/"
+
+	// the result of a command holds this much of the start and the end of its output
+	outputHeadSize = 64 * 1024
+	outputTailSize = 64 * 1024
+	// the full output is kept in a temporary file and uploaded up to this size
+	maxArtifactSize = 64 * 1024 * 1024
+)
+
+// boundedBuffer collects stdout and stderr, which are written from different goroutines.
+// Only the head and the tail of the output are kept in memory. Once the output exceeds them,
+// it is written to the spill of the command instead, if there is one.
+type boundedBuffer struct {
+	mu      sync.Mutex
+	head    []byte
+	tail    []byte
+	size    int64
+	spill   *outputSpill
+	spilled bool
+}
+
+func newBoundedBuffer(ctx context.Context) *boundedBuffer {
+	return &boundedBuffer{spill: spillFromContext(ctx)}
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := min(len(p), outputHeadSize-len(b.head))
+	b.head = append(b.head, p[:n]...)
+	b.tail = append(b.tail, p[n:]...)
+	b.size += int64(len(p))
+
+	if b.spilled {
+		b.spill.write(p)
+	} else if b.truncated() && b.spill != nil {
+		b.spill.write(b.head)
+		b.spill.write(b.tail)
+		b.spilled = true
+	}
+
+	// trim the tail in bulk rather than on every write
+	if len(b.tail) > 2*outputTailSize {
+		b.tail = append(b.tail[:0], b.tail[len(b.tail)-outputTailSize:]...)
+	}
+
+	return len(p), nil
+}
+
+// truncated must be called with b.mu held.
+func (b *boundedBuffer) truncated() bool {
+	return b.size > outputHeadSize+outputTailSize
+}
+
+func (b *boundedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.truncated() {
+		return string(b.head) + string(b.tail)
+	}
+
+	head := b.head[:completeRunes(b.head)]
+	tail := b.tail[len(b.tail)-outputTailSize:]
+	for i := 0; i < utf8.UTFMax && len(tail) > 0 && !utf8.RuneStart(tail[0]); i++ {
+		tail = tail[1:]
+	}
+	omitted := b.size - int64(len(head)) - int64(len(tail))
+
+	return fmt.Sprintf("%s\n... %d bytes omitted ...\n%s", head, omitted, tail)
+}
+
+// outputSpill holds the full output of the processes of a command whose output exceeds
+// what its result can hold, to be uploaded as an artifact when the command finishes.
+type outputSpill struct {
+	mu   sync.Mutex
+	file *os.File
+	size int64 // total size of the output, including what exceeds maxArtifactSize
+	err  error
+}
+
+type spillKey struct{}
+
+// withOutputSpill returns a context whose processes, started by runCmdWithStream or runShell,
+// write their output to spill once it is truncated.
+func withOutputSpill(ctx context.Context, spill *outputSpill) context.Context {
+	return context.WithValue(ctx, spillKey{}, spill)
+}
+
+func spillFromContext(ctx context.Context) *outputSpill {
+	spill, _ := ctx.Value(spillKey{}).(*outputSpill)
+	return spill
+}
+
+func (s *outputSpill) write(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	written := s.size
+	s.size += int64(len(p))
+	if s.err != nil || written >= maxArtifactSize {
+		return
+	}
+
+	if s.file == nil {
+		// CreateTemp makes the file readable only by alpamon
+		s.file, s.err = os.CreateTemp("", "alpamon-output-*")
+		if s.err != nil {
+			log.Warn().Err(s.err).Msg("Failed to create a file for the command output.")
+			return
+		}
+	}
+	_, s.err = s.file.Write(p[:min(int64(len(p)), maxArtifactSize-written)])
+}
+
+// outputSize returns the size of the truncated output, or 0 if no output has been truncated.
+func (s *outputSpill) outputSize() int64 {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+// upload sends the full output to Alpacon as a multipart file, like the upload command does.
+func (s *outputSpill) upload(cr *CommandRunner) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	body, contentType, err := multipartFile(s.file, fmt.Sprintf("%s.log", cr.command.ID))
+	if err != nil {
+		return err
+	}
+	url := utils.JoinPath(config.ActiveEndpoint().ServerURL, fmt.Sprintf(eventCommandOutputURL, cr.command.ID))
+	_, statusCode, err := cr.apiSession.MultipartRequest(url, body.open, body.size(), contentType, fileUploadTimeout)
+	if err != nil {
+		return err
+	}
+	if statusCode < http.StatusOK || statusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%s", http.StatusText(statusCode))
+	}
+
+	return nil
+}
+
+// fileBody is a multipart body with a file as its content. The file is read from its path
+// as the body is sent, so that it is not held in memory, and can be read again to resend it.
+type fileBody struct {
+	path     string
+	fileSize int64
+	header   []byte
+	trailer  []byte
+}
+
+// multipartFile returns a multipart body with the current content of file.
+func multipartFile(file *os.File, name string) (*fileBody, string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	_, err = writer.CreateFormFile("content", name)
+	if err != nil {
+		return nil, "", err
+	}
+	header := bytes.Clone(buf.Bytes())
+	buf.Reset()
+	err = writer.Close()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &fileBody{
+		path:     file.Name(),
+		fileSize: info.Size(),
+		header:   header,
+		trailer:  buf.Bytes(),
+	}, writer.FormDataContentType(), nil
+}
+
+func (b *fileBody) size() int64 {
+	return int64(len(b.header)) + b.fileSize + int64(len(b.trailer))
+}
+
+func (b *fileBody) open() (io.ReadCloser, error) {
+	file, err := os.Open(b.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(bytes.NewReader(b.header), io.LimitReader(file, b.fileSize), bytes.NewReader(b.trailer)),
+		Closer: file,
+	}, nil
+}
+
+func (s *outputSpill) remove() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file != nil {
+		_ = s.file.Close()
+		_ = os.Remove(s.file.Name())
+	}
+}
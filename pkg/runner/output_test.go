@@ -0,0 +1,233 @@
+package runner
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/alpacanetworks/alpamon/pkg/scheduler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSpill returns a context that spills to a new spill, which is removed after the test.
+func newTestSpill(t *testing.T) (context.Context, *outputSpill) {
+	spill := &outputSpill{}
+	t.Cleanup(spill.remove)
+
+	return withOutputSpill(context.Background(), spill), spill
+}
+
+func spillContent(t *testing.T, spill *outputSpill) string {
+	require.NotNil(t, spill.file)
+	content, err := os.ReadFile(spill.file.Name())
+	require.NoError(t, err)
+
+	return string(content)
+}
+
+func TestBoundedBuffer(t *testing.T) {
+	head := strings.Repeat("h", outputHeadSize)
+	tail := strings.Repeat("t", outputTailSize)
+
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"empty", nil, ""},
+		{"small", []string{"a", "b\n", "c"}, "ab\nc"},
+		{"exactly full", []string{head, tail}, head + tail},
+		{
+			name:   "truncated",
+			writes: []string{head, "omitted", tail},
+			want:   head + "\n... 7 bytes omitted ...\n" + tail,
+		},
+		{
+			name:   "truncated in small writes",
+			writes: append(strings.Split(head+"omitted", ""), tail),
+			want:   head + "\n... 7 bytes omitted ...\n" + tail,
+		},
+		{
+			name:   "many tails",
+			writes: []string{head, tail, tail, tail},
+			want:   head + fmt.Sprintf("\n... %d bytes omitted ...\n", 2*outputTailSize) + tail,
+		},
+		{
+			// a rune split by the head or the tail is left out
+			name:   "runes",
+			writes: []string{head[:outputHeadSize-1] + "é", "omitted", "é" + tail[1:]},
+			want:   head[:outputHeadSize-1] + fmt.Sprintf("\n... %d bytes omitted ...\n", 2+7+2) + tail[1:],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBoundedBuffer(context.Background())
+			for _, w := range tt.writes {
+				n, err := b.Write([]byte(w))
+				require.NoError(t, err)
+				assert.Equal(t, len(w), n)
+			}
+			assert.Equal(t, tt.want, b.String())
+		})
+	}
+}
+
+func TestBoundedBufferSpill(t *testing.T) {
+	ctx, spill := newTestSpill(t)
+
+	// nothing is spilled until the output is truncated
+	b := newBoundedBuffer(ctx)
+	small := strings.Repeat("a", outputHeadSize)
+	_, _ = b.Write([]byte(small))
+	assert.Nil(t, spill.file)
+	assert.Zero(t, spill.outputSize())
+
+	// then the full output is, in order
+	rest := strings.Repeat("b", outputTailSize) + "c"
+	_, _ = b.Write([]byte(rest))
+	_, _ = b.Write([]byte("d"))
+	assert.Equal(t, small+rest+"d", spillContent(t, spill))
+	assert.Equal(t, int64(len(small+rest+"d")), spill.outputSize())
+
+	// the processes of a command share its spill
+	other := newBoundedBuffer(ctx)
+	_, _ = other.Write([]byte(small + rest))
+	assert.Equal(t, small+rest+"d"+small+rest, spillContent(t, spill))
+
+	// without a spill, the output is only truncated
+	assert.Nil(t, newBoundedBuffer(context.Background()).spill)
+	assert.Zero(t, (*outputSpill)(nil).outputSize())
+}
+
+func TestOutputSpillLimit(t *testing.T) {
+	_, spill := newTestSpill(t)
+	spill.size = maxArtifactSize - 4
+
+	spill.write([]byte("abcdefgh"))
+	spill.write([]byte("ijkl"))
+	assert.Equal(t, "abcd", spillContent(t, spill), "the artifact is cut at maxArtifactSize")
+	assert.Equal(t, int64(maxArtifactSize+8), spill.outputSize(), "the size counts all of the output")
+}
+
+func TestOutputSpillUpload(t *testing.T) {
+	var path, name, content string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		file, header, err := r.FormFile("content")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer func() { _ = file.Close() }()
+		data, _ := io.ReadAll(file)
+		name, content = header.Filename, string(data)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	defer func(url string) { config.GlobalSettings.ServerURL = url }(config.GlobalSettings.ServerURL)
+	config.GlobalSettings.ServerURL = server.URL
+
+	ctx, spill := newTestSpill(t)
+	output := strings.Repeat("0123456789", (outputHeadSize+outputTailSize)/10+1)
+	_, _ = newBoundedBuffer(ctx).Write([]byte(output))
+
+	cr := &CommandRunner{command: Command{ID: "id"}, apiSession: &scheduler.Session{Client: server.Client()}}
+	require.NoError(t, spill.upload(cr))
+	assert.Equal(t, fmt.Sprintf(eventCommandOutputURL, "id"), path)
+	assert.Equal(t, "id.log", name)
+	assert.Equal(t, output, content)
+
+	// the spill can still be removed after the upload
+	spill.remove()
+	_, err := os.Stat(spill.file.Name())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestOutputSpillUploadCompressed(t *testing.T) {
+	var encodings []string
+	var content string
+	unsupported := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			// the session check, which negotiates compression
+			w.Header().Set("Accept-Encoding", "gzip")
+			_, _ = w.Write([]byte(`{"commissioned": true}`))
+			return
+		}
+
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			if unsupported {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(zr)
+		}
+		file, _, err := r.FormFile("content")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer func() { _ = file.Close() }()
+		data, _ := io.ReadAll(file)
+		content = string(data)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	defer func(url string) { config.GlobalSettings.ServerURL = url }(config.GlobalSettings.ServerURL)
+	defer func(coding string) { config.GlobalSettings.Compression = coding }(config.GlobalSettings.Compression)
+	config.GlobalSettings.ServerURL = server.URL
+	config.GlobalSettings.Compression = "gzip"
+
+	session := &scheduler.Session{Client: server.Client()}
+	require.True(t, session.CheckSession(context.Background()))
+	require.True(t, session.CompressionEnabled())
+
+	ctx, spill := newTestSpill(t)
+	output := strings.Repeat("0123456789", (outputHeadSize+outputTailSize)/10+1)
+	_, _ = newBoundedBuffer(ctx).Write([]byte(output))
+
+	cr := &CommandRunner{command: Command{ID: "id"}, apiSession: session}
+	require.NoError(t, spill.upload(cr))
+	assert.Equal(t, []string{"gzip"}, encodings)
+	assert.Equal(t, output, content)
+
+	// a server that rejects compressed bodies gets the file again, as is
+	encodings, content, unsupported = nil, "", true
+	require.NoError(t, spill.upload(cr))
+	assert.Equal(t, []string{"gzip", ""}, encodings)
+	assert.Equal(t, output, content)
+	assert.False(t, session.CompressionEnabled())
+}
+
+func TestOutputSpillUploadFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+	defer func(url string) { config.GlobalSettings.ServerURL = url }(config.GlobalSettings.ServerURL)
+	config.GlobalSettings.ServerURL = server.URL
+
+	ctx, spill := newTestSpill(t)
+	_, _ = newBoundedBuffer(ctx).Write(make([]byte, outputHeadSize+outputTailSize+1))
+
+	cr := &CommandRunner{command: Command{ID: "id"}, apiSession: &scheduler.Session{Client: server.Client()}}
+	assert.EqualError(t, spill.upload(cr), http.StatusText(http.StatusForbidden))
+
+	// a spill that could not be written is not uploaded
+	spill.err = os.ErrPermission
+	assert.ErrorIs(t, spill.upload(cr), os.ErrPermission)
+}
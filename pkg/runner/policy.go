@@ -0,0 +1,210 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/ini.v1"
+)
+
+// policyDir holds the local command policy. Every *.conf file in it is read in name order,
+// and each section of a file is a rule:
+//
+//	[no-reboot]
+//	action = deny
+//	shell = internal
+//	command = reboot, shutdown
+//
+// shell, command, user and group are comma-separated lists and line is a regular expression
+// searched in the command line. A rule matches if all of its conditions match, and a missing
+// condition matches anything. The first matching rule decides, and commands are allowed if none matches.
+const policyDir = "/etc/alpamon/policy.d"
+
+type policyRule struct {
+	name     string
+	allow    bool
+	shells   []string
+	commands []string // internal command names
+	users    []string
+	groups   []string
+	line     *regexp.Regexp
+}
+
+// checkPolicy returns an error if the local policy denies the command.
+// The policy is read for every command, so changes take effect without a restart.
+// If the policy can not be read, every command is denied.
+func checkPolicy(cmd Command) error {
+	rules, err := loadPolicy(policyDir)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to load command policy, denying command %s: %s > %s", cmd.ID, cmd.Shell, cmd.Line)
+		return fmt.Errorf("command policy could not be loaded: %w", err)
+	}
+
+	return decidePolicy(rules, cmd)
+}
+
+// decidePolicy applies the first rule that matches the command.
+func decidePolicy(rules []policyRule, cmd Command) error {
+	username, groupname := effectiveUser(cmd)
+	for _, rule := range rules {
+		if !rule.match(cmd, username, groupname) {
+			continue
+		}
+		if rule.allow {
+			return nil
+		}
+		log.Warn().Msgf("Command %s denied by policy rule %s: %s > %s (user: %s, group: %s)",
+			cmd.ID, rule.name, cmd.Shell, cmd.Line, username, groupname)
+		return fmt.Errorf("command has been denied by local policy rule %s", rule.name)
+	}
+
+	return nil
+}
+
+func loadPolicy(dir string) ([]policyRule, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []policyRule
+	for _, file := range files {
+		// regular expressions may contain ; and #
+		iniData, err := ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, file)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, section := range iniData.Sections() {
+			if section.Name() == ini.DefaultSection {
+				if len(section.Keys()) > 0 {
+					return nil, fmt.Errorf("%s: keys must be in a rule section", file)
+				}
+				continue
+			}
+
+			rule, err := parsePolicyRule(section)
+			if err != nil {
+				return nil, fmt.Errorf("%s: rule %s: %w", file, section.Name(), err)
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, nil
+}
+
+func parsePolicyRule(section *ini.Section) (policyRule, error) {
+	rule := policyRule{name: section.Name()}
+
+	for _, key := range section.Keys() {
+		value := strings.TrimSpace(key.Value())
+		switch key.Name() {
+		case "action":
+			switch value {
+			case "allow":
+				rule.allow = true
+			case "deny":
+				rule.allow = false
+			default:
+				return rule, fmt.Errorf("action must be allow or deny, got %q", value)
+			}
+		case "shell":
+			rule.shells = splitList(value)
+		case "command":
+			rule.commands = splitList(value)
+		case "user":
+			rule.users = splitList(value)
+		case "group":
+			rule.groups = splitList(value)
+		case "line":
+			if value == "" {
+				continue
+			}
+			line, err := regexp.Compile(value)
+			if err != nil {
+				return rule, err
+			}
+			rule.line = line
+		default:
+			return rule, fmt.Errorf("unknown key %s", key.Name())
+		}
+	}
+
+	if !section.HasKey("action") {
+		return rule, fmt.Errorf("action is required")
+	}
+
+	return rule, nil
+}
+
+func (r policyRule) match(cmd Command, username, groupname string) bool {
+	if len(r.shells) > 0 && !slices.Contains(r.shells, cmd.Shell) {
+		return false
+	}
+	if len(r.commands) > 0 && (cmd.Shell != "internal" || !slices.Contains(r.commands, internalCommandName(cmd.Line))) {
+		return false
+	}
+	if len(r.users) > 0 && !slices.Contains(r.users, username) {
+		return false
+	}
+	if len(r.groups) > 0 && !slices.Contains(r.groups, groupname) {
+		return false
+	}
+	if r.line != nil && !r.line.MatchString(cmd.Line) {
+		return false
+	}
+
+	return true
+}
+
+// effectiveUser returns the user and group the command runs as.
+// Commands without a user, including internal commands, run as alpamon itself.
+func effectiveUser(cmd Command) (string, string) {
+	username, groupname := cmd.User, cmd.Group
+	if cmd.Shell == "internal" || username == "" {
+		username, groupname = "", ""
+		if usr, err := user.LookupId(strconv.Itoa(os.Getuid())); err == nil {
+			username = usr.Username
+		}
+		if grp, err := user.LookupGroupId(strconv.Itoa(os.Getgid())); err == nil {
+			groupname = grp.Name
+		}
+	} else if groupname == "" {
+		groupname = username
+	}
+
+	return username, groupname
+}
+
+// internalCommandName returns the name of an internal command, as handleInternalCmd reads it.
+func internalCommandName(line string) string {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return ""
+	}
+	if name, err := strconv.Unquote(args[0]); err == nil {
+		return name
+	}
+
+	return args[0]
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,183 @@
+package runner
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writePolicy writes files, by name, to a new policy directory.
+func writePolicy(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+
+	return dir
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir := writePolicy(t, map[string]string{
+		"20-deny.conf": `
+[deny-root]
+action = deny
+user = root
+`,
+		"10-allow.conf": `
+[allow-ls]
+action = allow
+shell = system, script
+line = ^ls( |$)
+
+[allow-comment]
+action = allow
+line = a;b#c
+`,
+		"ignored.txt": `
+[ignored]
+action = deny
+`,
+	})
+
+	rules, err := loadPolicy(dir)
+	require.NoError(t, err)
+	require.Len(t, rules, 3)
+
+	// files are read in name order, and rules in file order
+	assert.Equal(t, "allow-ls", rules[0].name)
+	assert.Equal(t, "allow-comment", rules[1].name)
+	assert.Equal(t, "deny-root", rules[2].name)
+
+	assert.True(t, rules[0].allow)
+	assert.Equal(t, []string{"system", "script"}, rules[0].shells)
+	assert.Equal(t, "^ls( |$)", rules[0].line.String())
+	assert.Equal(t, "a;b#c", rules[1].line.String(), "inline comments are not stripped")
+	assert.False(t, rules[2].allow)
+	assert.Equal(t, []string{"root"}, rules[2].users)
+
+	rules, err = loadPolicy(t.TempDir())
+	assert.NoError(t, err)
+	assert.Empty(t, rules)
+
+	rules, err = loadPolicy(filepath.Join(t.TempDir(), "missing"))
+	assert.NoError(t, err, "a missing policy directory allows everything")
+	assert.Empty(t, rules)
+}
+
+func TestLoadPolicyInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"invalid action", "[rule]\naction = maybe\n"},
+		{"missing action", "[rule]\nshell = system\n"},
+		{"unknown key", "[rule]\naction = deny\nusers = root\n"},
+		{"invalid line", "[rule]\naction = deny\nline = (\n"},
+		{"key outside a rule", "action = deny\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writePolicy(t, map[string]string{
+				"10-valid.conf":   "[allow-all]\naction = allow\n",
+				"20-invalid.conf": tt.content,
+			})
+
+			// one invalid file fails the whole policy
+			_, err := loadPolicy(dir)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestDecidePolicy(t *testing.T) {
+	rules, err := loadPolicy(writePolicy(t, map[string]string{
+		"policy.conf": `
+[allow-ls]
+action = allow
+shell = system
+line = ^ls( |$)
+
+[deny-power]
+action = deny
+shell = internal
+command = reboot, shutdown
+
+[deny-root-system]
+action = deny
+shell = system
+user = root
+
+[deny-wheel]
+action = deny
+group = wheel
+
+[deny-rm]
+action = deny
+line = \brm\s+-rf\b
+`,
+	}))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		cmd     Command
+		allowed bool
+	}{
+		{"first match wins", Command{Shell: "system", Line: "ls -al", User: "root"}, true},
+		{"user", Command{Shell: "system", Line: "id", User: "root"}, false},
+		{"other user", Command{Shell: "system", Line: "id", User: "alice"}, true},
+		{"other shell", Command{Shell: "script", Line: "id", User: "root"}, true},
+		{"group", Command{Shell: "system", Line: "id", User: "alice", Group: "wheel"}, false},
+		{"group defaults to user", Command{Shell: "system", Line: "id", User: "wheel"}, false},
+		{"line", Command{Shell: "script", Line: "cd /tmp && rm -rf *", User: "alice"}, false},
+		{"line prefix", Command{Shell: "system", Line: "lsblk", User: "root"}, false},
+		{"internal command", Command{Shell: "internal", Line: "reboot"}, false},
+		{"quoted internal command", Command{Shell: "internal", Line: `"shutdown"`}, false},
+		{"other internal command", Command{Shell: "internal", Line: "ping"}, true},
+		{"command needs internal shell", Command{Shell: "script", Line: "reboot", User: "alice"}, true},
+		{"no match", Command{Shell: "system", Line: "uptime", User: "alice"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := decidePolicy(rules, tt.cmd)
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+
+	assert.NoError(t, decidePolicy(nil, Command{Shell: "system", Line: "id", User: "root"}), "no rules allow everything")
+}
+
+func TestEffectiveUser(t *testing.T) {
+	usr, err := user.LookupId(strconv.Itoa(os.Getuid()))
+	require.NoError(t, err)
+	grp, err := user.LookupGroupId(strconv.Itoa(os.Getgid()))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		cmd       Command
+		username  string
+		groupname string
+	}{
+		{"user and group", Command{Shell: "system", User: "alice", Group: "staff"}, "alice", "staff"},
+		{"group defaults to user", Command{Shell: "system", User: "alice"}, "alice", "alice"},
+		{"no user", Command{Shell: "system", Group: "staff"}, usr.Username, grp.Name},
+		{"internal", Command{Shell: "internal", User: "alice", Group: "staff"}, usr.Username, grp.Name},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username, groupname := effectiveUser(tt.cmd)
+			assert.Equal(t, tt.username, username)
+			assert.Equal(t, tt.groupname, groupname)
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package runner
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	commandWorkers   = 16
+	commandQueueSize = 256
+)
+
+var (
+	errCommandCancelled = errors.New("command cancelled")
+	errCommandTimedOut  = errors.New("command timed out")
+)
+
+// runningCommands holds the commands that are queued or running, by command ID.
+var runningCommands = &commandRegistry{
+	commands: make(map[string]*CommandRunner),
+}
+
+type commandRegistry struct {
+	mu       sync.Mutex
+	commands map[string]*CommandRunner
+}
+
+func (r *commandRegistry) add(cr *CommandRunner) {
+	if cr.command.ID == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.commands[cr.command.ID] = cr
+}
+
+func (r *commandRegistry) remove(cr *CommandRunner) {
+	if cr.command.ID == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.commands[cr.command.ID] == cr {
+		delete(r.commands, cr.command.ID)
+	}
+}
+
+// cancel stops the command with the given ID, killing its process group.
+// It returns false if the command is not queued or running.
+func (r *commandRegistry) cancel(id string) bool {
+	r.mu.Lock()
+	cr, ok := r.commands[id]
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	cr.cancel(errCommandCancelled)
+
+	return true
+}
+
+// commandPool runs commands on a fixed number of workers.
+// Commands wait in a bounded queue when all workers are busy.
+type commandPool struct {
+	jobs chan *CommandRunner
+}
+
+func newCommandPool(workers, queueSize int) *commandPool {
+	pool := &commandPool{
+		jobs: make(chan *CommandRunner, queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+
+	return pool
+}
+
+func (p *commandPool) work() {
+	for cr := range p.jobs {
+		cr.Run()
+	}
+}
+
+// submit queues the command, or reports it as failed if the queue is full.
+func (p *commandPool) submit(cr *CommandRunner) {
+	runningCommands.add(cr)
+
+	select {
+	case p.jobs <- cr:
+	default:
+		runningCommands.remove(cr)
+		log.Warn().Msgf("Too many commands are queued, rejecting: %s > %s", cr.command.Shell, cr.command.Line)
+		cr.fin(&commandFin{
+			Success: false,
+			Result:  "Too many commands are running, please try again later.",
+		})
+	}
+}
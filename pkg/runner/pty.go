@@ -2,7 +2,6 @@ package runner
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -35,6 +34,8 @@ type PtyClient struct {
 	groupname     string
 	homeDirectory string
 	sessionID     string
+	limits        config.Limits
+	cgroup        *commandCgroup // nil if the shell is not limited
 	wsToPty       chan []byte
 	ptyToWs       chan []byte
 	isRecovering  atomic.Bool // default : false
@@ -55,31 +56,31 @@ func init() {
 }
 
 func NewPtyClient(data CommandData, apiSession *scheduler.Session) *PtyClient {
+	serverURL := config.ActiveEndpoint().ServerURL
 	headers := http.Header{
-		"Authorization": {fmt.Sprintf(`id="%s", key="%s"`, config.GlobalSettings.ID, config.GlobalSettings.Key)},
-		"Origin":        {config.GlobalSettings.ServerURL},
+		"Authorization": {authorization()},
+		"Origin":        {serverURL},
 	}
 	return &PtyClient{
 		apiSession:    apiSession,
 		requestHeader: headers,
-		url:           strings.Replace(config.GlobalSettings.ServerURL, "http", "ws", 1) + data.URL,
+		url:           strings.Replace(serverURL, "http", "ws", 1) + data.URL,
 		rows:          data.Rows,
 		cols:          data.Cols,
 		username:      data.Username,
 		groupname:     data.Groupname,
 		homeDirectory: data.HomeDirectory,
 		sessionID:     data.SessionID,
+		limits:        config.GlobalSettings.Limits.Override(data.Limits),
 		wsToPty:       make(chan []byte, bufferSize),
 		ptyToWs:       make(chan []byte, bufferSize),
 	}
 }
 
 func (pc *PtyClient) initializePtySession() error {
-	var err error
-	dialer := websocket.Dialer{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: !config.GlobalSettings.SSLVerify,
-		},
+	dialer, err := utils.NewDialer()
+	if err != nil {
+		return fmt.Errorf("failed to load TLS or proxy configuration: %w", err)
 	}
 	pc.conn, _, err = dialer.Dial(pc.url, pc.requestHeader)
 	if err != nil {
@@ -92,6 +93,13 @@ func (pc *PtyClient) initializePtySession() error {
 		return fmt.Errorf("failed to get user/env: %w", err)
 	}
 	pc.setPtyCmdSysProcAttrAndEnv(uid, gid, groupIds, env)
+	if !pc.limits.IsZero() {
+		pc.cgroup, err = newCommandCgroup("pty", pc.limits)
+		if err != nil {
+			log.Debug().Err(err).Msg("Failed to create a cgroup, running Websh without resource limits.")
+		}
+		pc.cgroup.apply(pc.cmd)
+	}
 
 	initialSize := &pty.Winsize{Rows: pc.rows, Cols: pc.cols}
 	pc.ptmx, err = pty.StartWithSize(pc.cmd, initialSize)
@@ -265,6 +273,11 @@ func (pc *PtyClient) close() {
 		_ = pc.cmd.Wait()
 	}
 
+	if note := pc.cgroup.report(); note != "" {
+		log.Info().Msgf("Websh session %s: %s", pc.sessionID, note)
+	}
+	pc.cgroup.remove()
+
 	if terminals[pc.sessionID] != nil {
 		delete(terminals, pc.sessionID)
 	}
@@ -300,7 +313,7 @@ func (pc *PtyClient) recovery() error {
 	retryBackoff.InitialInterval = 1 * time.Second
 	retryBackoff.MaxInterval = 30 * time.Second
 	retryBackoff.MaxElapsedTime = 0 // until ctx timeout
-	retryBackoff.RandomizationFactor = 0
+	retryBackoff.RandomizationFactor = connectJitter
 
 	operation := func() error {
 		select {
@@ -325,13 +338,17 @@ func (pc *PtyClient) recovery() error {
 				log.Warn().Err(err).Msg("Failed to parse reconnect response.")
 				return fmt.Errorf("unmarshal error: %w", err)
 			}
-			pc.url = strings.Replace(config.GlobalSettings.ServerURL, "http", "ws", 1) + resp.WebsocketURL
+			// follow the active endpoint, which may have changed since the channel was opened
+			serverURL := config.ActiveEndpoint().ServerURL
+			pc.url = strings.Replace(serverURL, "http", "ws", 1) + resp.WebsocketURL
+			pc.requestHeader.Set("Origin", serverURL)
 
-			dialer := websocket.Dialer{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: !config.GlobalSettings.SSLVerify,
-				},
+			dialer, err := utils.NewDialer()
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to load TLS or proxy configuration.")
+				return err
 			}
+			pc.requestHeader.Set("Authorization", authorization())
 			conn, _, err := dialer.Dial(pc.url, pc.requestHeader)
 			if err != nil {
 				log.Warn().Err(err).Msg("Websh reconnect failed.")
@@ -0,0 +1,74 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/alpacanetworks/alpamon/pkg/utils"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	rotateKeyURL        = "/api/servers/servers/-/rotate-key/"
+	rotateKeyConfirmURL = "/api/servers/servers/-/rotate-key/confirm/"
+)
+
+// rotateKey replaces the server key without restarting.
+// Alpacon issues a new key but keeps accepting the old one until the rotation is confirmed,
+// so the old key is restored whenever a step fails before that.
+func (cr *CommandRunner) rotateKey() (exitCode int, result string) {
+	resp, statusCode, err := cr.apiSession.Post(rotateKeyURL, nil, 10)
+	if err != nil {
+		return 1, fmt.Sprintf("rotatekey: Failed to request a new key. %s", err)
+	}
+	if !utils.IsSuccessStatusCode(statusCode) {
+		return 1, fmt.Sprintf("rotatekey: Failed to request a new key. %d %s", statusCode, resp)
+	}
+
+	var data rotateKeyResponse
+	err = json.Unmarshal(resp, &data)
+	if err != nil || data.Key == "" {
+		return 1, "rotatekey: Invalid response from the server."
+	}
+
+	id, oldKey := config.GlobalSettings.ID, config.ServerKey()
+	err = cr.apiSession.CheckKey(id, data.Key)
+	if err != nil {
+		return 1, fmt.Sprintf("rotatekey: New key failed verification, keeping the current key. %s", err)
+	}
+
+	err = config.SaveKey(data.Key)
+	if err != nil {
+		return 1, fmt.Sprintf("rotatekey: Failed to save the new key, keeping the current key. %s", err)
+	}
+	cr.setKey(id, data.Key)
+
+	resp, statusCode, err = cr.apiSession.Post(rotateKeyConfirmURL, nil, 10)
+	if err == nil && statusCode != http.StatusOK && statusCode != http.StatusNoContent {
+		err = fmt.Errorf("%d %s", statusCode, resp)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to confirm the new key, rolling back.")
+		cr.setKey(id, oldKey)
+		if saveErr := config.SaveKey(oldKey); saveErr != nil {
+			log.Error().Err(saveErr).Msg("Failed to restore the previous key in the config file.")
+		}
+		return 1, fmt.Sprintf("rotatekey: Failed to confirm the new key, rolled back to the current key. %s", err)
+	}
+
+	log.Info().Msg("Server key has been rotated.")
+	if cr.wsClient != nil {
+		cr.wsClient.reconnect()
+	}
+
+	return 0, "Server key has been rotated."
+}
+
+// setKey switches the credentials used for new requests and connections.
+// Websh connections pick them up when they reconnect.
+func (cr *CommandRunner) setKey(id, key string) {
+	config.SetServerKey(key)
+	cr.apiSession.SetKey(id, key)
+}
@@ -0,0 +1,97 @@
+package runner
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/alpacanetworks/alpamon/pkg/utils"
+	"github.com/rs/zerolog/log"
+)
+
+// scriptInterpreters are the interpreters a script can be run with. They are looked up in PATH.
+var scriptInterpreters = []string{"bash", "sh", "python3", "perl"}
+
+// runScript writes a script to a private file of the user and runs it with the interpreter,
+// like `python3 script.py args...` on a terminal. The file is removed afterwards.
+func runScript(ctx context.Context, script, interpreter string, args []string, username, groupname, cwd, stdin string, env map[string]string, stream *outputStream) (exitCode int, result string) {
+	usr, err := utils.GetSystemUser(username)
+	if err != nil {
+		return 1, err.Error()
+	}
+
+	var sysProcAttr *syscall.SysProcAttr
+	if username != "root" {
+		sysProcAttr, err = demote(username, groupname)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to demote user.")
+			return -1, err.Error()
+		}
+	}
+
+	var cred *syscall.Credential
+	if sysProcAttr != nil {
+		cred = sysProcAttr.Credential
+	}
+	path, err := writeScript(script, cred)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to write script.")
+		return 1, err.Error()
+	}
+	defer func() { _ = os.Remove(path) }()
+
+	cmd := exec.CommandContext(ctx, interpreter, append([]string{path}, args...)...)
+	cmd.SysProcAttr = sysProcAttr
+	setProcessGroup(ctx, cmd)
+
+	if env != nil {
+		vars := getDefaultEnv()
+		for key, value := range env {
+			vars[key] = value
+		}
+		cmd.Env = environ(vars)
+	}
+	cmd.Dir, err = commandDir(usr.HomeDir, cwd)
+	if err != nil {
+		return 1, err.Error()
+	}
+
+	if stdin != "" {
+		file, err := stdinFile(stdin)
+		if err != nil {
+			return 1, err.Error()
+		}
+		defer func() { _ = file.Close() }()
+		cmd.Stdin = file
+	}
+
+	log.Debug().Msgf("Executing %s script as user '%s' (group: '%s') with arguments '%s'", interpreter, username, groupname, strings.Join(args, " "))
+	return runWithOutput(ctx, cmd, stream)
+}
+
+// writeScript writes the script to a temporary file that only the user running it can read.
+// Files in the temporary directory can not be replaced by other users, as it is sticky.
+func writeScript(script string, cred *syscall.Credential) (string, error) {
+	file, err := os.CreateTemp("", "alpamon-script-*")
+	if err != nil {
+		return "", err
+	}
+
+	if cred != nil {
+		err = file.Chown(int(cred.Uid), int(cred.Gid))
+	}
+	if err == nil {
+		_, err = file.WriteString(script)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+
+	return file.Name(), nil
+}
@@ -2,10 +2,14 @@ package runner
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -15,6 +19,13 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	killWaitDelay = 5 * time.Second
+	shellPath     = "/bin/sh"
+)
+
+// demote returns the credential of the user, with the given group and the supplementary groups of the user,
+// for processes run on behalf of the user.
 func demote(username, groupname string) (*syscall.SysProcAttr, error) {
 	currentUid := os.Getuid()
 
@@ -48,75 +59,196 @@ func demote(username, groupname string) (*syscall.SysProcAttr, error) {
 		return nil, err
 	}
 
+	groupIds, err := usr.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]uint32, 0, len(groupIds))
+	for _, gidStr := range groupIds {
+		gidInt, err := strconv.Atoi(gidStr)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, uint32(gidInt))
+	}
+
 	log.Debug().Msgf("Demote permission to match user: %s, group: %s.", username, groupname)
 
 	return &syscall.SysProcAttr{
 		Credential: &syscall.Credential{
-			Uid: uint32(uid),
-			Gid: uint32(gid),
+			Uid:    uint32(uid),
+			Gid:    uint32(gid),
+			Groups: groups,
 		},
 	}, nil
 }
 
-func demoteFtp(username, groupname string) (*syscall.SysProcAttr, error) {
-	currentUid := os.Getuid()
-
-	if username == "" || groupname == "" {
-		log.Debug().Msg("No username or groupname provided, running as the current user.")
-		return nil, nil
+// setProcessGroup runs cmd in its own process group, so that cancelling it also kills its children,
+// and in the cgroup of ctx. It must be called after cmd.SysProcAttr is set.
+func setProcessGroup(ctx context.Context, cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
 	}
+	// do not wait for orphaned children holding the output pipe
+	cmd.WaitDelay = killWaitDelay
+	cgroupFromContext(ctx).apply(cmd)
+}
 
-	if currentUid != 0 {
-		log.Warn().Msg("Alpamon is not running as root. Falling back to the current user.")
-		return nil, nil
+// runWithOutput runs cmd and returns its exit status, like a shell reports it, and its combined output.
+func runWithOutput(ctx context.Context, cmd *exec.Cmd, stream *outputStream) (exitCode int, result string) {
+	output := newBoundedBuffer(ctx)
+	if stream != nil {
+		cmd.Stdout = stream.writer("stdout", output)
+		cmd.Stderr = stream.writer("stderr", output)
+	} else {
+		cmd.Stdout = output
+		cmd.Stderr = output
 	}
 
-	usr, err := user.Lookup(username)
+	err := cmd.Run()
 	if err != nil {
-		return nil, fmt.Errorf("there is no corresponding %s username in this server", username)
+		if _, ok := err.(*exec.ExitError); !ok {
+			return 1, err.Error()
+		}
 	}
 
-	group, err := user.LookupGroup(groupname)
+	return exitStatus(err), output.String()
+}
+
+// runShell runs a command line with /bin/sh as the user, in cwd, or the home directory if empty,
+// and returns its exit status and combined output. The environment of alpamon is kept if env is nil.
+func runShell(ctx context.Context, line, username, groupname, cwd, stdin string, env map[string]string, stream *outputStream) (exitCode int, result string) {
+	usr, err := utils.GetSystemUser(username)
 	if err != nil {
-		return nil, fmt.Errorf("there is no corresponding %s groupname in this server", groupname)
+		return 1, err.Error()
 	}
 
-	uid, err := strconv.Atoi(usr.Uid)
+	cmd := exec.CommandContext(ctx, shellPath, "-c", line)
+	if username != "root" {
+		cmd.SysProcAttr, err = demote(username, groupname)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to demote user.")
+			return -1, err.Error()
+		}
+	}
+	setProcessGroup(ctx, cmd)
+
+	if env != nil {
+		vars := getDefaultEnv()
+		for key, value := range env {
+			vars[key] = value
+		}
+		cmd.Env = environ(vars)
+	}
+	cmd.Dir, err = commandDir(usr.HomeDir, cwd)
 	if err != nil {
-		return nil, err
+		return 1, err.Error()
 	}
 
-	gid, err := strconv.Atoi(group.Gid)
+	if stdin != "" {
+		file, err := stdinFile(stdin)
+		if err != nil {
+			return 1, err.Error()
+		}
+		defer func() { _ = file.Close() }()
+		cmd.Stdin = file
+	}
+
+	log.Debug().Msgf("Executing command as user '%s' (group: '%s') -> '%s'", username, groupname, line)
+	return runWithOutput(ctx, cmd, stream)
+}
+
+// stdinFile returns an unlinked file with the content, for the standard input of a command.
+func stdinFile(content string) (*os.File, error) {
+	file, err := os.CreateTemp("", "alpamon-stdin-*")
 	if err != nil {
 		return nil, err
 	}
+	_ = os.Remove(file.Name())
 
-	groupIds, err := usr.GroupIds()
+	_, err = file.WriteString(content)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
 	if err != nil {
+		_ = file.Close()
 		return nil, err
 	}
 
-	groups := make([]uint32, 0, len(groupIds))
-	for _, gidStr := range groupIds {
-		gidInt, err := strconv.Atoi(gidStr)
-		if err != nil {
-			return nil, err
+	return file, nil
+}
+
+// exitStatus returns the exit status of a process as a shell reports it.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) {
+		if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
 		}
-		groups = append(groups, uint32(gidInt))
+		return exitError.ExitCode()
 	}
 
-	log.Debug().Msgf("Demote permission to match user: %s, group: %s.", username, groupname)
+	return 1
+}
 
-	return &syscall.SysProcAttr{
-		Credential: &syscall.Credential{
-			Uid:    uint32(uid),
-			Gid:    uint32(gid),
-			Groups: groups,
-		},
-	}, nil
+func environ(vars map[string]string) []string {
+	env := make([]string, 0, len(vars))
+	for key, value := range vars {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(env)
+
+	return env
 }
 
-func runCmdWithOutput(args []string, username, groupname string, env map[string]string, timeout int) (exitCode int, result string) {
+// isName reports whether s is a valid name of an environment variable.
+func isName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// commandDir returns cwd, relative to home unless absolute, or home if cwd is empty.
+// exec reports a missing directory as a missing executable, so it is checked beforehand.
+func commandDir(home, cwd string) (string, error) {
+	if cwd == "" {
+		return home, nil
+	}
+
+	dir := cwd
+	if !filepath.IsAbs(cwd) {
+		dir = filepath.Join(home, cwd)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("cd: %s: No such directory", dir)
+	}
+
+	return dir, nil
+}
+
+func runCmdWithOutput(ctx context.Context, args []string, username, groupname string, env map[string]string, timeout int) (exitCode int, result string) {
+	return runCmdWithStream(ctx, args, username, groupname, env, timeout, nil)
+}
+
+// runCmdWithStream is like runCmdWithOutput, but also sends the output to stream while the command runs.
+func runCmdWithStream(ctx context.Context, args []string, username, groupname string, env map[string]string, timeout int, stream *outputStream) (exitCode int, result string) {
 	if env != nil {
 		defaultEnv := getDefaultEnv()
 		for key, value := range defaultEnv {
@@ -139,13 +271,12 @@ func runCmdWithOutput(args []string, username, groupname string, env map[string]
 		}
 	}
 
-	var ctx context.Context
 	var cancel context.CancelFunc
 
 	if timeout > 0 {
-		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
 	} else {
-		ctx, cancel = context.WithCancel(context.Background())
+		ctx, cancel = context.WithCancel(ctx)
 	}
 	defer cancel()
 
@@ -161,6 +292,8 @@ func runCmdWithOutput(args []string, username, groupname string, env map[string]
 		}
 	}
 
+	setProcessGroup(ctx, cmd)
+
 	for key, value := range env {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
 	}
@@ -172,13 +305,22 @@ func runCmdWithOutput(args []string, username, groupname string, env map[string]
 	cmd.Dir = usr.HomeDir
 
 	log.Debug().Msgf("Executing command as user '%s' (group: '%s') -> '%s'", username, groupname, strings.Join(args, " "))
-	output, err := cmd.CombinedOutput()
+	output := newBoundedBuffer(ctx)
+	if stream != nil {
+		cmd.Stdout = stream.writer("stdout", output)
+		cmd.Stderr = stream.writer("stderr", output)
+	} else {
+		cmd.Stdout = output
+		cmd.Stderr = output
+	}
+
+	err = cmd.Run()
 	if err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
-			return exitError.ExitCode(), string(output)
+			return exitError.ExitCode(), output.String()
 		}
 		return -1, err.Error()
 	}
 
-	return 0, string(output)
+	return 0, output.String()
 }
@@ -0,0 +1,168 @@
+package runner
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDemote(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("runs as root")
+	}
+	usr, err := user.Lookup("root")
+	require.NoError(t, err)
+	groupIds, err := usr.GroupIds()
+	require.NoError(t, err)
+
+	sysProcAttr, err := demote("root", "root")
+	require.NoError(t, err)
+	require.NotNil(t, sysProcAttr.Credential)
+	assert.Zero(t, sysProcAttr.Credential.Uid)
+	assert.Zero(t, sysProcAttr.Credential.Gid)
+
+	// the supplementary groups of the user are always set, or the process keeps those of alpamon
+	groups := make([]uint32, 0, len(groupIds))
+	for _, gid := range groupIds {
+		id, err := strconv.Atoi(gid)
+		require.NoError(t, err)
+		groups = append(groups, uint32(id))
+	}
+	assert.Equal(t, groups, sysProcAttr.Credential.Groups)
+
+	sysProcAttr, err = demote("", "")
+	assert.NoError(t, err)
+	assert.Nil(t, sysProcAttr)
+
+	_, err = demote("no-such-user-here", "root")
+	assert.Error(t, err)
+}
+
+func TestRunShell(t *testing.T) {
+	dir := t.TempDir()
+	env := map[string]string{"HOME": dir, "GREETING": "hello world"}
+	run := func(line string) (int, string) {
+		return runShell(context.Background(), line, "", "", dir, "", env, nil)
+	}
+
+	tests := []struct {
+		line     string
+		exitCode int
+		result   string
+	}{
+		{`echo "a  b" 'c  d' e\ f`, 0, "a  b c  d e f\n"},
+		{`echo $GREETING | tr a-z A-Z`, 0, "HELLO WORLD\n"},
+		{`printf 'a\nb\nc\n' | grep -v b | wc -l | tr -d ' '`, 0, "2\n"},
+		{`false && echo no || echo yes`, 0, "yes\n"},
+		{`false; echo $?`, 0, "1\n"},
+		{`true | false`, 1, ""},
+		{`echo one > out.txt; echo two >> out.txt; cat < out.txt`, 0, "one\ntwo\n"},
+		{`sh -c 'echo out; echo err >&2' 2>&1 >/dev/null`, 0, "err\n"},
+		{`X=1 env | grep ^X=; Y=2; echo $Y`, 0, "X=1\n2\n"},
+		{`export Z=3; sh -c 'echo $Z'`, 0, "3\n"},
+		{`mkdir sub && cd sub && pwd && cd - >/dev/null && pwd`, 0, dir + "/sub\n" + dir + "\n"},
+		{`touch b.txt a.txt; echo *.txt`, 0, "a.txt b.txt out.txt\n"},
+		{`set -- x y; echo $# $2`, 0, "2 y\n"},
+		{`exit 3; echo no`, 3, ""},
+		{`kill -9 $$`, 137, ""},
+		{`no-such-command-here`, 127, ""},
+		{`echo "unterminated`, 2, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			exitCode, result := run(tt.line)
+			assert.Equal(t, tt.exitCode, exitCode, result)
+			if tt.result != "" || tt.exitCode == 0 {
+				assert.Equal(t, tt.result, result)
+			}
+		})
+	}
+
+	exitCode, result := runShell(context.Background(), "pwd", "", "", dir+"/sub", "", env, nil)
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, dir+"/sub\n", result)
+
+	exitCode, result = runShell(context.Background(), "pwd", "", "", "missing", "", env, nil)
+	assert.Equal(t, 1, exitCode)
+	assert.Contains(t, result, "No such directory")
+
+	exitCode, result = runShell(context.Background(), "read a; read b; echo $b $a", "", "", dir, "one\ntwo\n", env, nil)
+	assert.Equal(t, 0, exitCode)
+	assert.Equal(t, "two one\n", result)
+}
+
+func TestRunShellCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// the children of the shell are killed along with it
+	start := time.Now()
+	exitCode, _ := runShell(ctx, "sleep 30 | cat; echo done", "", "", t.TempDir(), "", map[string]string{}, nil)
+	assert.NotZero(t, exitCode)
+	assert.Less(t, time.Since(start), killWaitDelay)
+}
+
+func TestRunShellDemotion(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("runs as root")
+	}
+	usr, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("requires the nobody user")
+	}
+	grp, err := user.LookupGroupId(usr.Gid)
+	require.NoError(t, err)
+
+	// a directory the user can write to, with a file it can not read
+	dir := t.TempDir()
+	require.NoError(t, os.Chmod(filepath.Dir(dir), 0755))
+	require.NoError(t, os.Chmod(dir, 0777))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("top secret"), 0600))
+
+	run := func(line string) (int, string) {
+		return runShell(context.Background(), line, usr.Username, grp.Name, dir, "", map[string]string{}, nil)
+	}
+	ids := usr.Uid + " " + usr.Gid + "\n"
+
+	tests := []struct {
+		name     string
+		line     string
+		exitCode int
+		result   string
+	}{
+		{"shell", `echo $(id -u) $(id -g)`, 0, ids},
+		{"every stage", `id -u | { cat; id -g; }`, 0, usr.Uid + "\n" + usr.Gid + "\n"},
+		{"read", `cat secret.txt`, 1, ""},
+		{"input", `cat < secret.txt`, 2, ""},
+		{"output", `echo replaced > secret.txt`, 2, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exitCode, result := run(tt.line)
+			assert.Equal(t, tt.exitCode, exitCode, result)
+			assert.NotContains(t, result, "top secret")
+			if tt.result != "" {
+				assert.Equal(t, tt.result, result)
+			}
+		})
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "secret.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "top secret", string(content))
+
+	// files are created by the user
+	exitCode, result := run(`echo created > created.txt`)
+	require.Equal(t, 0, exitCode, result)
+	info, err := os.Stat(filepath.Join(dir, "created.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, usr.Uid, strconv.Itoa(int(info.Sys().(*syscall.Stat_t).Uid)))
+}
@@ -0,0 +1,198 @@
+package runner
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+)
+
+const (
+	signatureVersion = "alpamon-command-v1"
+	// commands with a timeout, cwd, stdin or login are signed with these fields appended
+	signatureVersionV2 = "alpamon-command-v2"
+	// jobs are signed with run_at and cron appended to the fields of signatureVersionV2
+	signatureVersionV3 = "alpamon-command-v3"
+	// control queries (cancel, quit and reconnect) are signed apart from commands and from each other,
+	// so that the signature of a command can not cancel it and a cancel can not take the agent offline
+	controlSignatureVersion = "alpamon-%s-v1"
+)
+
+var (
+	errCommandUnsigned = errors.New("command is not signed")
+	errCommandReplayed = errors.New("command has already been received")
+)
+
+// seenSignatures holds the IDs of verified commands until their timestamps expire,
+// so that a captured command can not be replayed within config.GlobalSettings.SigningMaxAge.
+var seenSignatures = &signatureCache{
+	seen: make(map[string]time.Time),
+}
+
+type signatureCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// verifyCommand checks the signature and the timestamp of the command against [signing] settings.
+// Unsigned commands are accepted unless signatures are enforced, and signed commands are accepted
+// as is if no public key is configured.
+func verifyCommand(cmd Command) error {
+	return verifySignature(cmd, signedMessage(cmd))
+}
+
+// verifyControl checks the signature of a control query like verifyCommand does for commands.
+// Only the ID and the timestamp of the command are set in a control query, and the ID is empty
+// for quit and reconnect.
+func verifyControl(query string, cmd Command) error {
+	return verifySignature(cmd, controlMessage(query, cmd))
+}
+
+func verifySignature(cmd Command, message []byte) error {
+	key := config.GlobalSettings.SigningKey
+	if cmd.Signature == "" {
+		if config.GlobalSettings.SigningEnforce {
+			return errCommandUnsigned
+		}
+		return nil
+	}
+	if key == nil {
+		return nil
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(cmd.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if !ed25519.Verify(key, message, signature) {
+		return errors.New("signature does not match")
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, cmd.Timestamp)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %w", err)
+	}
+	maxAge := config.GlobalSettings.SigningMaxAge
+	age := time.Since(timestamp)
+	if age > maxAge || age < -maxAge {
+		return fmt.Errorf("timestamp %s is out of the allowed window of %s", cmd.Timestamp, maxAge)
+	}
+
+	return nil
+}
+
+// checkReplay returns errCommandReplayed if a signed command with the same ID has been seen
+// within the allowed window. Unsigned commands are not checked.
+func (c *signatureCache) checkReplay(cmd Command) error {
+	return c.check(cmd, cmd.ID)
+}
+
+// checkControlReplay is checkReplay for control queries, which are told apart by their signatures.
+func (c *signatureCache) checkControlReplay(query string, cmd Command) error {
+	return c.check(cmd, query+":"+cmd.Signature)
+}
+
+func (c *signatureCache) check(cmd Command, key string) error {
+	if cmd.Signature == "" || config.GlobalSettings.SigningKey == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for id, expiry := range c.seen {
+		if now.After(expiry) {
+			delete(c.seen, id)
+		}
+	}
+
+	if _, ok := c.seen[key]; ok {
+		return errCommandReplayed
+	}
+	// a command is stale once it is older than the window, wherever its clock is
+	c.seen[key] = now.Add(2 * config.GlobalSettings.SigningMaxAge)
+
+	return nil
+}
+
+// signedMessage returns the bytes signed by Alpacon. Each field is written as a netstring
+// ("<length>:<value>,") so that no field can be shifted into another. Group and env are signed
+// along with the ID, shell, line, user, data and timestamp, as they change how the command runs.
+// Env entries are sorted by name. Timeout, cwd, stdin and login follow in signatureVersionV2,
+// which is used only if any of them is set so that signers of v1 keep working.
+// Run at and cron follow those in signatureVersionV3, used only for jobs.
+func signedMessage(cmd Command) []byte {
+	var buf bytes.Buffer
+	field := netstringWriter(&buf)
+
+	job := cmd.RunAt != "" || cmd.Cron != ""
+	extended := job || cmd.Timeout != 0 || cmd.Cwd != "" || cmd.Stdin != "" || cmd.Login
+	if job {
+		field(signatureVersionV3)
+	} else if extended {
+		field(signatureVersionV2)
+	} else {
+		field(signatureVersion)
+	}
+	field(cmd.ID)
+	field(cmd.Shell)
+	field(cmd.Line)
+	field(cmd.User)
+	field(cmd.Group)
+	field(cmd.Data)
+	field(cmd.Timestamp)
+
+	names := make([]string, 0, len(cmd.Env))
+	for name := range cmd.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	field(strconv.Itoa(len(names)))
+	for _, name := range names {
+		field(name)
+		field(cmd.Env[name])
+	}
+
+	if extended {
+		field(strconv.Itoa(cmd.Timeout))
+		field(cmd.Cwd)
+		field(cmd.Stdin)
+		field(strconv.FormatBool(cmd.Login))
+	}
+	if job {
+		field(cmd.RunAt)
+		field(cmd.Cron)
+	}
+
+	return buf.Bytes()
+}
+
+// controlMessage returns the bytes signed by Alpacon for a control query, the netstrings
+// of controlSignatureVersion for the query, the ID and the timestamp.
+func controlMessage(query string, cmd Command) []byte {
+	var buf bytes.Buffer
+	field := netstringWriter(&buf)
+
+	field(fmt.Sprintf(controlSignatureVersion, query))
+	field(cmd.ID)
+	field(cmd.Timestamp)
+
+	return buf.Bytes()
+}
+
+func netstringWriter(buf *bytes.Buffer) func(string) {
+	return func(value string) {
+		buf.WriteString(strconv.Itoa(len(value)))
+		buf.WriteByte(':')
+		buf.WriteString(value)
+		buf.WriteByte(',')
+	}
+}
@@ -0,0 +1,217 @@
+package runner
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withSigningKey configures key to verify signatures for the duration of the test.
+func withSigningKey(t *testing.T, key ed25519.PublicKey, enforce bool) {
+	saved := config.GlobalSettings
+	t.Cleanup(func() { config.GlobalSettings = saved })
+
+	config.GlobalSettings.SigningKey = key
+	config.GlobalSettings.SigningEnforce = enforce
+	config.GlobalSettings.SigningMaxAge = 5 * time.Minute
+}
+
+func sign(key ed25519.PrivateKey, message []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, message))
+}
+
+func TestSignedMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  Command
+		want string
+	}{
+		{
+			name: "v1",
+			cmd: Command{
+				ID: "id", Shell: "system", Line: "ls -al", User: "root", Group: "root",
+				Timestamp: "2025-04-01T00:00:00Z", Env: map[string]string{"LANG": "C", "A": "1"},
+			},
+			want: "18:alpamon-command-v1,2:id,6:system,6:ls -al,4:root,4:root,0:,20:2025-04-01T00:00:00Z," +
+				"1:2,1:A,1:1,4:LANG,1:C,",
+		},
+		{
+			name: "v2",
+			cmd: Command{
+				ID: "id", Shell: "system", Line: "cat", User: "alice",
+				Timeout: 30, Cwd: "/tmp", Stdin: "a,b", Login: true,
+			},
+			want: "18:alpamon-command-v2,2:id,6:system,3:cat,5:alice,0:,0:,0:,1:0," +
+				"2:30,4:/tmp,3:a,b,4:true,",
+		},
+		{
+			name: "v3",
+			cmd: Command{
+				ID: "id", Shell: "internal", Line: "reboot", Cron: "0 3 * * *",
+			},
+			want: "18:alpamon-command-v3,2:id,8:internal,6:reboot,0:,0:,0:,0:,1:0," +
+				"1:0,0:,0:,5:false,0:,9:0 3 * * *,",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, string(signedMessage(tt.cmd)))
+		})
+	}
+
+	// a value can not be shifted into the next field
+	a := Command{ID: "1", Line: "ab", User: "c"}
+	b := Command{ID: "1", Line: "a", User: "bc"}
+	assert.NotEqual(t, signedMessage(a), signedMessage(b))
+}
+
+func TestVerifyCommand(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	_, otherPrivate, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	withSigningKey(t, public, true)
+
+	signed := func(cmd Command, key ed25519.PrivateKey) Command {
+		cmd.Signature = sign(key, signedMessage(cmd))
+		return cmd
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	base := Command{ID: "id", Shell: "system", Line: "ls", User: "root", Timestamp: now}
+
+	tests := []struct {
+		name  string
+		cmd   func() Command
+		valid bool
+	}{
+		{"valid v1", func() Command { return signed(base, private) }, true},
+		{"valid v2", func() Command {
+			cmd := base
+			cmd.Cwd = "/tmp"
+			return signed(cmd, private)
+		}, true},
+		{"valid v3", func() Command {
+			cmd := base
+			cmd.RunAt = "2025-04-01T03:00:00Z"
+			return signed(cmd, private)
+		}, true},
+		{"tampered line", func() Command {
+			cmd := signed(base, private)
+			cmd.Line = "rm -rf /"
+			return cmd
+		}, false},
+		{"tampered env", func() Command {
+			cmd := signed(base, private)
+			cmd.Env = map[string]string{"LD_PRELOAD": "/tmp/x.so"}
+			return cmd
+		}, false},
+		{"added login", func() Command {
+			cmd := signed(base, private)
+			cmd.Login = true
+			return cmd
+		}, false},
+		{"added cron", func() Command {
+			cmd := signed(base, private)
+			cmd.Cron = "* * * * *"
+			return cmd
+		}, false},
+		{"wrong key", func() Command { return signed(base, otherPrivate) }, false},
+		{"expired", func() Command {
+			cmd := base
+			cmd.Timestamp = time.Now().Add(-10 * time.Minute).UTC().Format(time.RFC3339)
+			return signed(cmd, private)
+		}, false},
+		{"from the future", func() Command {
+			cmd := base
+			cmd.Timestamp = time.Now().Add(10 * time.Minute).UTC().Format(time.RFC3339)
+			return signed(cmd, private)
+		}, false},
+		{"invalid timestamp", func() Command {
+			cmd := base
+			cmd.Timestamp = "yesterday"
+			return signed(cmd, private)
+		}, false},
+		{"invalid encoding", func() Command {
+			cmd := base
+			cmd.Signature = "not base64!"
+			return cmd
+		}, false},
+		{"unsigned", func() Command { return base }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyCommand(tt.cmd())
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+
+	config.GlobalSettings.SigningEnforce = false
+	assert.NoError(t, verifyCommand(base), "unsigned commands are accepted unless enforced")
+	tampered := signed(base, private)
+	tampered.Line = "id"
+	assert.Error(t, verifyCommand(tampered), "invalid signatures are rejected even if not enforced")
+}
+
+func TestVerifyControl(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	withSigningKey(t, public, true)
+
+	cmd := Command{ID: "id", Shell: "system", Line: "sleep 100", Timestamp: time.Now().UTC().Format(time.RFC3339)}
+	assert.Equal(t, "17:alpamon-cancel-v1,2:id,"+"20:"+cmd.Timestamp+",", string(controlMessage("cancel", cmd)))
+
+	cancel := Command{ID: cmd.ID, Timestamp: cmd.Timestamp}
+	assert.ErrorIs(t, verifyControl("cancel", cancel), errCommandUnsigned)
+
+	cancel.Signature = sign(private, controlMessage("cancel", cancel))
+	assert.NoError(t, verifyControl("cancel", cancel))
+
+	// the signature of a command does not cancel it
+	cmd.Signature = sign(private, signedMessage(cmd))
+	assert.Error(t, verifyControl("cancel", cmd))
+	cancel.Signature = cmd.Signature
+	assert.Error(t, verifyControl("cancel", cancel))
+
+	// quit and reconnect are signed as well, each with its own version
+	quit := Command{Timestamp: cmd.Timestamp}
+	assert.Equal(t, "15:alpamon-quit-v1,0:,"+"20:"+cmd.Timestamp+",", string(controlMessage("quit", quit)))
+	assert.ErrorIs(t, verifyControl("quit", quit), errCommandUnsigned)
+	quit.Signature = sign(private, controlMessage("quit", quit))
+	assert.NoError(t, verifyControl("quit", quit))
+	assert.Error(t, verifyControl("reconnect", quit), "the signature of a quit does not reconnect")
+	cancel.Signature = sign(private, controlMessage("cancel", cancel))
+	assert.Error(t, verifyControl("quit", cancel), "the signature of a cancel does not quit")
+}
+
+func TestCheckReplay(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	withSigningKey(t, public, true)
+
+	cache := &signatureCache{seen: make(map[string]time.Time)}
+	cmd := Command{ID: "id", Timestamp: time.Now().UTC().Format(time.RFC3339)}
+	cmd.Signature = sign(private, signedMessage(cmd))
+
+	assert.NoError(t, cache.checkReplay(cmd))
+	assert.ErrorIs(t, cache.checkReplay(cmd), errCommandReplayed)
+
+	other := cmd
+	other.ID = "other"
+	assert.NoError(t, cache.checkReplay(other))
+
+	// control queries are told apart by their signatures
+	quit := Command{Timestamp: cmd.Timestamp}
+	quit.Signature = sign(private, controlMessage("quit", quit))
+	assert.NoError(t, cache.checkControlReplay("quit", quit))
+	assert.ErrorIs(t, cache.checkControlReplay("quit", quit), errCommandReplayed)
+	assert.NoError(t, cache.checkControlReplay("reconnect", quit))
+}
@@ -0,0 +1,142 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/alpacanetworks/alpamon/pkg/db/ent"
+	"github.com/alpacanetworks/alpamon/pkg/db/ent/command"
+	"github.com/alpacanetworks/alpamon/pkg/scheduler"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	storeTimeout = 5 * time.Second
+	// finished commands are kept this long to answer re-deliveries
+	commandRetention = 7 * 24 * time.Hour
+)
+
+// commandStore records the commands received from Alpacon in the local database,
+// so that a command re-delivered after a reconnect is not run again.
+// Without a database client every command is treated as new.
+type commandStore struct {
+	client *ent.Client
+}
+
+func newCommandStore(client *ent.Client) *commandStore {
+	return &commandStore{client: client}
+}
+
+// received returns true if the command has been received before, in which case
+// the stored fin of a finished command is sent again.
+func (s *commandStore) received(cmd Command) bool {
+	if s.client == nil || cmd.ID == "" {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	row, err := s.client.Command.Query().Where(command.CommandID(cmd.ID)).Only(ctx)
+	if err != nil {
+		if !ent.IsNotFound(err) {
+			log.Error().Err(err).Msgf("Failed to look up command %s.", cmd.ID)
+		}
+		return false
+	}
+
+	if row.State == command.StateFinished && len(row.Fin) > 0 {
+		log.Info().Msgf("Command %s has already finished, sending its result again.", cmd.ID)
+		scheduler.Rqueue.Post(fmt.Sprintf(eventCommandFinURL, cmd.ID), row.Fin, 10, time.Time{}, 0)
+	} else {
+		log.Info().Msgf("Command %s is already running, ignoring the duplicate.", cmd.ID)
+	}
+
+	return true
+}
+
+// start records the command as running.
+func (s *commandStore) start(cmd Command) {
+	if s.client == nil || cmd.ID == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	err := s.client.Command.Create().
+		SetCommandID(cmd.ID).
+		SetShell(cmd.Shell).
+		SetLine(cmd.Line).
+		SetState(command.StateRunning).
+		SetCreatedAt(time.Now()).
+		Exec(ctx)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to record command %s.", cmd.ID)
+	}
+}
+
+// finish stores the fin of the command, to be sent again if the command is re-delivered.
+func (s *commandStore) finish(id string, payload *commandFin) {
+	if s.client == nil || id == "" {
+		return
+	}
+
+	fin, err := json.Marshal(payload)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to marshal fin of command %s.", id)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	err = s.client.Command.Update().
+		Where(command.CommandID(id)).
+		SetState(command.StateFinished).
+		SetFin(fin).
+		SetFinishedAt(time.Now()).
+		Exec(ctx)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to record the result of command %s.", id)
+	}
+}
+
+// recover reports the commands left running by a previous process as failed,
+// and removes finished commands older than commandRetention.
+func (s *commandStore) recover() {
+	if s.client == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	rows, err := s.client.Command.Query().Where(command.StateEQ(command.StateRunning)).All(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to look up interrupted commands.")
+		return
+	}
+
+	for _, row := range rows {
+		log.Warn().Msgf("Command %s was interrupted by a restart, reporting it as failed.", row.CommandID)
+		payload := &commandFin{
+			Success: false,
+			Result:  "Command was interrupted as alpamon has been restarted.",
+		}
+		s.finish(row.CommandID, payload)
+		scheduler.Rqueue.Post(fmt.Sprintf(eventCommandFinURL, row.CommandID), payload, 10, time.Time{}, 0)
+	}
+
+	_, err = s.client.Command.Delete().
+		Where(
+			command.StateEQ(command.StateFinished),
+			command.CreatedAtLT(time.Now().Add(-commandRetention)),
+		).
+		Exec(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to delete old commands.")
+	}
+}
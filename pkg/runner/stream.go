@@ -0,0 +1,195 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/alpacanetworks/alpamon/pkg/scheduler"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	eventCommandProgressURL = "/api/events/commands/%s/progress/"
+
+	streamFlushInterval = 1 * time.Second
+	streamChunkSize     = 16 * 1024
+
+	// chunks waiting to be sent, later chunks are dropped while Alpacon is slow or unreachable
+	streamMaxChunks = 16
+	// chunks older than this are dropped instead of sent, as the output is in the result anyway
+	streamChunkTTL = 10 * time.Second
+	streamTimeout  = 5 // seconds
+)
+
+// outputStream sends the output of a running command to Alpacon in chunks.
+// Chunks are numbered across the whole command so that the server can put them in order,
+// and each chunk holds the output of a single stream, stdout or stderr.
+// Chunks are sent one at a time by the stream itself rather than by the request queue,
+// so that at most streamMaxChunks are held per command and all of them are sent or dropped
+// before the fin. A dropped chunk leaves a gap in the numbers and marks the next chunk as truncated.
+type outputStream struct {
+	mu        sync.Mutex
+	session   *scheduler.Session
+	url       string
+	seq       int
+	stream    string
+	buf       bytes.Buffer
+	timer     *time.Timer
+	truncated bool // a chunk has been dropped since the last one queued
+	chunks    chan *commandProgress
+	done      chan struct{}
+	closed    bool
+}
+
+func newOutputStream(session *scheduler.Session, commandID string) *outputStream {
+	s := &outputStream{
+		session: session,
+		url:     fmt.Sprintf(eventCommandProgressURL, commandID),
+		chunks:  make(chan *commandProgress, streamMaxChunks),
+		done:    make(chan struct{}),
+	}
+	go s.send()
+
+	return s
+}
+
+// writer returns a writer for stdout or stderr that also copies the output to combined.
+func (s *outputStream) writer(stream string, combined io.Writer) io.Writer {
+	return &streamWriter{
+		stream:   stream,
+		output:   s,
+		combined: combined,
+	}
+}
+
+func (s *outputStream) write(stream string, p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	if s.buf.Len() > 0 && s.stream != stream {
+		s.flush(true)
+	}
+	s.stream = stream
+	s.buf.Write(p)
+
+	if s.buf.Len() >= streamChunkSize {
+		s.flush(false)
+	} else if s.timer == nil {
+		s.timer = time.AfterFunc(streamFlushInterval, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.closed {
+				return
+			}
+			s.timer = nil
+			s.flush(false)
+		})
+	}
+}
+
+// flush must be called with s.mu held. Unless all is set,
+// an incomplete UTF-8 sequence at the end is kept for the next chunk.
+func (s *outputStream) flush(all bool) {
+	data := s.buf.Bytes()
+	n := len(data)
+	if !all {
+		n = completeRunes(data)
+	}
+	if n == 0 {
+		return
+	}
+
+	s.seq++
+	chunk := &commandProgress{
+		Seq:       s.seq,
+		Stream:    s.stream,
+		Data:      string(data[:n]),
+		Timestamp: time.Now(),
+		Truncated: s.truncated,
+	}
+	select {
+	case s.chunks <- chunk:
+		s.truncated = false
+	default:
+		s.truncated = true
+	}
+
+	s.buf.Next(n)
+}
+
+// send posts the queued chunks in order until the stream is closed.
+func (s *outputStream) send() {
+	defer close(s.done)
+
+	truncated := false
+	for chunk := range s.chunks {
+		if time.Since(chunk.Timestamp) > streamChunkTTL {
+			truncated = true
+			continue
+		}
+		chunk.Truncated = chunk.Truncated || truncated
+
+		_, statusCode, err := s.session.Post(s.url, chunk, streamTimeout)
+		if err != nil || statusCode < http.StatusOK || statusCode >= http.StatusMultipleChoices {
+			log.Debug().Err(err).Msgf("Failed to send output chunk %d: %d.", chunk.Seq, statusCode)
+			truncated = true
+			continue
+		}
+		truncated = false
+	}
+}
+
+// close sends the remaining output, and returns once every chunk has been sent or dropped.
+// It must be called before the fin is posted.
+func (s *outputStream) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.flush(true)
+	s.closed = true
+	close(s.chunks)
+	s.mu.Unlock()
+
+	<-s.done
+}
+
+// completeRunes returns the length of data without a trailing incomplete UTF-8 sequence.
+func completeRunes(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
+	}
+
+	return len(data)
+}
+
+type streamWriter struct {
+	stream   string
+	output   *outputStream
+	combined io.Writer
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.output.write(w.stream, p)
+
+	return w.combined.Write(p)
+}
@@ -0,0 +1,123 @@
+package runner
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/alpacanetworks/alpamon/pkg/scheduler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// progressServer records the chunks posted to it, after release is closed.
+type progressServer struct {
+	mu      sync.Mutex
+	chunks  []commandProgress
+	release chan struct{}
+}
+
+func newProgressServer(t *testing.T) (*progressServer, *scheduler.Session) {
+	ps := &progressServer{release: make(chan struct{})}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-ps.release
+		var chunk commandProgress
+		if err := json.NewDecoder(r.Body).Decode(&chunk); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ps.mu.Lock()
+		ps.chunks = append(ps.chunks, chunk)
+		ps.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(server.Close)
+	serverURL := config.GlobalSettings.ServerURL
+	t.Cleanup(func() { config.GlobalSettings.ServerURL = serverURL })
+	config.GlobalSettings.ServerURL = server.URL
+
+	return ps, &scheduler.Session{Client: server.Client()}
+}
+
+func (ps *progressServer) received() []commandProgress {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return append([]commandProgress(nil), ps.chunks...)
+}
+
+func TestOutputStreamClose(t *testing.T) {
+	ps, session := newProgressServer(t)
+	close(ps.release)
+
+	s := newOutputStream(session, "id")
+	s.write("stdout", []byte("a"))
+	s.write("stderr", []byte("b"))
+	s.write("stdout", []byte("c"))
+	s.close()
+
+	// every chunk has been sent once close returns, before the fin
+	chunks := ps.received()
+	require.Len(t, chunks, 3)
+	for i, want := range []struct{ stream, data string }{{"stdout", "a"}, {"stderr", "b"}, {"stdout", "c"}} {
+		assert.Equal(t, i+1, chunks[i].Seq)
+		assert.Equal(t, want.stream, chunks[i].Stream)
+		assert.Equal(t, want.data, chunks[i].Data)
+		assert.False(t, chunks[i].Truncated)
+	}
+
+	// nothing is sent after close
+	s.write("stdout", []byte("d"))
+	s.close()
+	assert.Len(t, ps.received(), 3)
+}
+
+func TestOutputStreamBounded(t *testing.T) {
+	ps, session := newProgressServer(t)
+
+	// while Alpacon does not respond, at most streamMaxChunks chunks wait, the others are dropped
+	s := newOutputStream(session, "id")
+	chunk := strings.Repeat("a", streamChunkSize)
+	total := streamMaxChunks + 10
+	for i := 0; i < total; i++ {
+		s.write("stdout", []byte(chunk))
+	}
+	assert.LessOrEqual(t, len(s.chunks), streamMaxChunks)
+
+	close(ps.release)
+	require.Eventually(t, func() bool { return len(s.chunks) == 0 }, 5*time.Second, 10*time.Millisecond)
+	s.write("stdout", []byte("end"))
+	s.close()
+
+	chunks := ps.received()
+	assert.Less(t, len(chunks), total+1)
+	for i := 1; i < len(chunks); i++ {
+		assert.Greater(t, chunks[i].Seq, chunks[i-1].Seq)
+	}
+	last := chunks[len(chunks)-1]
+	assert.Equal(t, total+1, last.Seq)
+	assert.Equal(t, "end", last.Data)
+	assert.True(t, last.Truncated, "the chunk after dropped ones is marked")
+}
+
+func TestOutputStreamTTL(t *testing.T) {
+	ps, session := newProgressServer(t)
+
+	s := newOutputStream(session, "id")
+	s.chunks <- &commandProgress{Seq: 1, Stream: "stdout", Data: "stale", Timestamp: time.Now().Add(-streamChunkTTL - time.Second)}
+	s.seq = 1
+	close(ps.release)
+	s.write("stdout", []byte("fresh"))
+	s.close()
+
+	chunks := ps.received()
+	require.Len(t, chunks, 1)
+	assert.Equal(t, 2, chunks[0].Seq)
+	assert.Equal(t, "fresh", chunks[0].Data)
+	assert.True(t, chunks[0].Truncated)
+}
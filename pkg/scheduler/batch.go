@@ -0,0 +1,258 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type batchMode int
+
+const (
+	// batchModeMerge sends the entries as a single JSON list.
+	batchModeMerge batchMode = iota
+	// batchModeCoalesce sends a single entry whose JSON object holds the keys of all entries,
+	// the later entries overriding the earlier ones.
+	batchModeCoalesce
+	// batchModeDelete deletes the items of a collection with a single DELETE of the collection,
+	// whose body is the JSON list of their IDs.
+	batchModeDelete
+)
+
+const (
+	// featuresHeader lists the features of Alpacon in the response to the session check.
+	featuresHeader = "X-Alpacon-Features"
+	// bulkFeature means that Alpacon accepts JSON lists on the endpoints of bulk rules.
+	bulkFeature = "bulk"
+)
+
+type batchRule struct {
+	method  string
+	prefix  string
+	mode    batchMode
+	window  time.Duration
+	maxSize int
+	bulk    bool // the rule changes the body of the request, which Alpacon must support
+}
+
+// batchRules lists the endpoints whose entries are held for a short window
+// and combined into a single request. Entries are grouped by method and exact URL,
+// except for batchModeDelete, which groups them by collection.
+var batchRules = []batchRule{
+	{method: http.MethodPost, prefix: "/api/history/logs/", mode: batchModeMerge, window: 1 * time.Second, maxSize: 100, bulk: true},
+	{method: http.MethodPatch, prefix: "/api/servers/servers/-/", mode: batchModeCoalesce, window: 1 * time.Second},
+	{method: http.MethodPut, prefix: "/api/servers/servers/-/commit/", mode: batchModeCoalesce, window: 1 * time.Second},
+	{method: http.MethodPost, prefix: "/api/proc/", mode: batchModeMerge, window: 1 * time.Second, maxSize: 100, bulk: true},
+	{method: http.MethodPatch, prefix: "/api/proc/", mode: batchModeCoalesce, window: 1 * time.Second},
+	{method: http.MethodDelete, prefix: "/api/proc/", mode: batchModeDelete, window: 1 * time.Second, maxSize: 100, bulk: true},
+}
+
+// bulkEnabled is set once Alpacon has advertised bulkFeature. Until then,
+// the entries of bulk rules are sent one by one.
+var bulkEnabled atomic.Bool
+
+// negotiateBulk enables the bulk rules if Alpacon lists bulkFeature in featuresHeader.
+func negotiateBulk(header http.Header) {
+	for _, value := range header.Values(featuresHeader) {
+		for _, feature := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(feature), bulkFeature) {
+				if !bulkEnabled.Swap(true) {
+					log.Debug().Msg("Alpacon accepts bulk requests, batching them.")
+				}
+				return
+			}
+		}
+	}
+
+	bulkEnabled.Store(false)
+}
+
+type batcher struct {
+	mu      sync.Mutex
+	pending map[string]*pendingBatch
+}
+
+type pendingBatch struct {
+	rule    batchRule
+	entries []PriorityEntry
+}
+
+func newBatcher() *batcher {
+	return &batcher{
+		pending: make(map[string]*pendingBatch),
+	}
+}
+
+func findBatchRule(method, url string) (batchRule, bool) {
+	for _, rule := range batchRules {
+		if rule.method == method && strings.HasPrefix(url, rule.prefix) {
+			if rule.bulk && !bulkEnabled.Load() {
+				return batchRule{}, false
+			}
+			return rule, true
+		}
+	}
+
+	return batchRule{}, false
+}
+
+// batchURL returns the URL the entries of a batch are sent to.
+func batchURL(rule batchRule, url string) string {
+	if rule.mode == batchModeDelete {
+		return path.Dir(strings.TrimSuffix(url, "/")) + "/"
+	}
+
+	return url
+}
+
+// batch holds the entry until the window of its rule elapses or the batch is full.
+func (rq *RequestQueue) batch(entry PriorityEntry, rule batchRule) {
+	key := entry.method + " " + batchURL(rule, entry.url)
+
+	rq.batcher.mu.Lock()
+	pb, ok := rq.batcher.pending[key]
+	if !ok {
+		pb = &pendingBatch{rule: rule}
+		rq.batcher.pending[key] = pb
+		time.AfterFunc(rule.window, func() {
+			rq.flush(key, pb)
+		})
+	}
+
+	pb.entries = append(pb.entries, entry)
+	full := rule.maxSize > 0 && len(pb.entries) >= rule.maxSize
+	rq.batcher.mu.Unlock()
+
+	if full {
+		rq.flush(key, pb)
+	}
+}
+
+// flush queues the pending batch for key, if it is still the given one.
+func (rq *RequestQueue) flush(key string, pb *pendingBatch) {
+	rq.batcher.mu.Lock()
+	if rq.batcher.pending[key] != pb {
+		rq.batcher.mu.Unlock()
+		return
+	}
+	delete(rq.batcher.pending, key)
+	rq.batcher.mu.Unlock()
+
+	merged, ok := mergeEntries(pb.entries, pb.rule)
+	if !ok {
+		for _, entry := range pb.entries {
+			rq.enqueue(entry)
+		}
+		return
+	}
+	rq.enqueue(merged)
+}
+
+// mergeEntries combines entries to the same endpoint into a single one, as the rule says.
+// The merged entry keeps the parts so that they can be retried or released one by one.
+// It returns false if the entries can not be combined, in which case they are sent one by one.
+func mergeEntries(entries []PriorityEntry, rule batchRule) (PriorityEntry, bool) {
+	if len(entries) == 1 {
+		return entries[0], true
+	}
+
+	merged := PriorityEntry{
+		priority: entries[0].priority,
+		method:   entries[0].method,
+		url:      batchURL(rule, entries[0].url),
+		due:      entries[0].due,
+		expiry:   entries[0].expiry,
+		retry:    RetryLimit,
+		batch:    &entries,
+	}
+	for _, entry := range entries {
+		if entry.priority < merged.priority {
+			merged.priority = entry.priority
+		}
+		if entry.due.Before(merged.due) {
+			merged.due = entry.due
+		}
+		// the batch lives as long as its longest-living part
+		if entry.expiry.IsZero() || (!merged.expiry.IsZero() && entry.expiry.After(merged.expiry)) {
+			merged.expiry = entry.expiry
+		}
+	}
+
+	var err error
+	switch rule.mode {
+	case batchModeMerge:
+		merged.data, err = mergeList(entries)
+	case batchModeCoalesce:
+		merged.data, err = mergeObjects(entries)
+	case batchModeDelete:
+		merged.data = deleteIDs(entries)
+	}
+	if err != nil {
+		log.Debug().Err(err).Msgf("Failed to merge batched entries, sending them one by one: %s %s", merged.method, merged.url)
+		return PriorityEntry{}, false
+	}
+
+	return merged, true
+}
+
+func mergeList(entries []PriorityEntry) ([]json.RawMessage, error) {
+	data := make([]json.RawMessage, 0, len(entries))
+	for _, entry := range entries {
+		body, err := marshalData(entry.data)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			data = append(data, body)
+		}
+	}
+
+	return data, nil
+}
+
+// mergeObjects merges the JSON objects of the entries key by key, so that no field is lost.
+func mergeObjects(entries []PriorityEntry) (map[string]json.RawMessage, error) {
+	data := make(map[string]json.RawMessage)
+	for _, entry := range entries {
+		body, err := marshalData(entry.data)
+		if err != nil {
+			return nil, err
+		}
+
+		var fields map[string]json.RawMessage
+		err = json.Unmarshal(body, &fields)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range fields {
+			data[key] = value
+		}
+	}
+
+	return data, nil
+}
+
+// deleteIDs returns the IDs of the items that the entries delete, the last element of their URL.
+func deleteIDs(entries []PriorityEntry) []string {
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, path.Base(strings.TrimSuffix(entry.url, "/")))
+	}
+
+	return ids
+}
+
+// parts returns the entries a merged entry is made of, or the entry itself.
+func (entry PriorityEntry) parts() []PriorityEntry {
+	if entry.batch != nil {
+		return *entry.batch
+	}
+
+	return []PriorityEntry{entry}
+}
@@ -0,0 +1,205 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeEntries(t *testing.T) {
+	now := time.Now()
+	rule, ok := findBatchRule(http.MethodPatch, "/api/servers/servers/-/")
+	require.True(t, ok)
+
+	tests := []struct {
+		name    string
+		entries []PriorityEntry
+		check   func(t *testing.T, merged PriorityEntry)
+	}{
+		{
+			name: "highest priority",
+			entries: []PriorityEntry{
+				{priority: 80, due: now},
+				{priority: 10, due: now},
+				{priority: 50, due: now},
+			},
+			check: func(t *testing.T, merged PriorityEntry) {
+				assert.Equal(t, 10, merged.priority)
+			},
+		},
+		{
+			name: "earliest due",
+			entries: []PriorityEntry{
+				{due: now.Add(time.Second)},
+				{due: now.Add(-time.Second)},
+				{due: now},
+			},
+			check: func(t *testing.T, merged PriorityEntry) {
+				assert.True(t, now.Add(-time.Second).Equal(merged.due))
+			},
+		},
+		{
+			name: "latest expiry",
+			entries: []PriorityEntry{
+				{due: now, expiry: now.Add(time.Minute)},
+				{due: now, expiry: now.Add(time.Hour)},
+			},
+			check: func(t *testing.T, merged PriorityEntry) {
+				assert.True(t, now.Add(time.Hour).Equal(merged.expiry))
+			},
+		},
+		{
+			name: "no expiry wins",
+			entries: []PriorityEntry{
+				{due: now, expiry: now.Add(time.Minute)},
+				{due: now},
+				{due: now, expiry: now.Add(time.Hour)},
+			},
+			check: func(t *testing.T, merged PriorityEntry) {
+				assert.True(t, merged.expiry.IsZero())
+			},
+		},
+		{
+			name: "parts",
+			entries: []PriorityEntry{
+				{due: now, retry: 1, spoolID: 1},
+				{due: now, retry: 2, spoolID: 2},
+			},
+			check: func(t *testing.T, merged PriorityEntry) {
+				assert.Equal(t, RetryLimit, merged.retry)
+				require.Len(t, merged.parts(), 2)
+				assert.Equal(t, 1, merged.parts()[0].spoolID)
+				assert.Equal(t, 2, merged.parts()[1].spoolID)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := range tt.entries {
+				tt.entries[i].method = http.MethodPatch
+				tt.entries[i].url = "/api/servers/servers/-/"
+				tt.entries[i].data = map[string]int{"load": i}
+			}
+			merged, ok := mergeEntries(tt.entries, rule)
+			require.True(t, ok)
+			tt.check(t, merged)
+		})
+	}
+}
+
+func TestMergeEntriesCoalesce(t *testing.T) {
+	rule, ok := findBatchRule(http.MethodPatch, "/api/servers/servers/-/")
+	require.True(t, ok)
+
+	merged, ok := mergeEntries([]PriorityEntry{
+		{data: map[string]interface{}{"load": 1.5, "hostname": "a"}},
+		{data: []byte(`{"load": 2.5}`)},
+		{data: `{"commissioned": true}`},
+	}, rule)
+	require.True(t, ok)
+
+	body, err := json.Marshal(merged.data)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"load": 2.5, "hostname": "a", "commissioned": true}`, string(body))
+
+	// bodies that are not objects can not be merged
+	_, ok = mergeEntries([]PriorityEntry{{data: `{"load": 1}`}, {data: `[1]`}}, rule)
+	assert.False(t, ok)
+}
+
+func TestMergeEntriesBulk(t *testing.T) {
+	defer bulkEnabled.Store(false)
+
+	_, ok := findBatchRule(http.MethodPost, "/api/history/logs/")
+	assert.False(t, ok, "bulk rules require the bulk feature of Alpacon")
+
+	negotiateBulk(http.Header{featuresHeader: {"compression, bulk"}})
+	rule, ok := findBatchRule(http.MethodPost, "/api/history/logs/")
+	require.True(t, ok)
+	merged, ok := mergeEntries([]PriorityEntry{{data: `{"msg": "a"}`}, {data: map[string]string{"msg": "b"}}}, rule)
+	require.True(t, ok)
+	body, err := json.Marshal(merged.data)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"msg": "a"}, {"msg": "b"}]`, string(body))
+
+	rule, ok = findBatchRule(http.MethodDelete, "/api/proc/users/12/")
+	require.True(t, ok)
+	merged, ok = mergeEntries([]PriorityEntry{{url: "/api/proc/users/12/"}, {url: "/api/proc/users/34/"}}, rule)
+	require.True(t, ok)
+	assert.Equal(t, "/api/proc/users/", merged.url)
+	assert.Equal(t, []string{"12", "34"}, merged.data)
+
+	negotiateBulk(http.Header{})
+	_, ok = findBatchRule(http.MethodDelete, "/api/proc/users/12/")
+	assert.False(t, ok)
+}
+
+func TestBatchPartialFailure(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		// the batch is rejected as a whole for its invalid part, then the part itself
+		if string(body) == `{"name":"bad"}` || len(bodies) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	defer func(url string) { config.GlobalSettings.ServerURL = url }(config.GlobalSettings.ServerURL)
+	config.GlobalSettings.ServerURL = server.URL
+	breaker = newCircuitBreaker()
+
+	client := newTestClient(t)
+	spool := newTestQueue(t, client)
+	reporter := NewReporter(0, &Session{Client: server.Client()})
+
+	now := time.Now()
+	var parts []PriorityEntry
+	for _, name := range []string{"bad", "good"} {
+		entry := PriorityEntry{priority: 10, method: http.MethodPost, url: "/api/proc/users/", due: now, retry: RetryLimit, data: `{"name":"` + name + `"}`}
+		id, err := spool.save(entry)
+		require.NoError(t, err)
+		entry.spoolID = id
+		parts = append(parts, entry)
+	}
+	merged, ok := mergeEntries(parts, batchRule{mode: batchModeMerge})
+	require.True(t, ok)
+
+	// the batch is rejected, so its parts are retried one by one
+	reporter.query(merged, noProbe)
+	assert.Equal(t, 2, Rqueue.queue.Size())
+	assert.Equal(t, 2, spool.count())
+
+	for i := 0; i < 2; i++ {
+		Rqueue.cond.L.Lock()
+		entry, err := Rqueue.get()
+		Rqueue.cond.L.Unlock()
+		require.NoError(t, err)
+		assert.Nil(t, entry.batch)
+		assert.Equal(t, RetryLimit-1, entry.retry)
+		reporter.query(entry, noProbe)
+	}
+
+	// only the invalid part is left, with its own retry state
+	assert.Equal(t, 1, spool.count())
+	row := client.SpoolEntry.Query().OnlyX(context.Background())
+	assert.Equal(t, `{"name":"bad"}`, string(row.Data))
+	assert.Equal(t, RetryLimit-2, row.Retry)
+	assert.Equal(t, 1, Rqueue.queue.Size())
+	assert.Equal(t, 1, reporter.Stats().Success)
+	assert.Equal(t, 3, reporter.Stats().Failure)
+}
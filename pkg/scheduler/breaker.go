@@ -0,0 +1,191 @@
+package scheduler
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	breakerThreshold  = 5
+	breakerMinBackoff = 5 * time.Second
+	breakerMaxBackoff = 5 * time.Minute
+	breakerJitter     = 0.2
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker is shared by all reporters so that they back off together
+// when Alpacon is unavailable or asks us to slow down.
+var breaker = newCircuitBreaker()
+
+func newCircuitBreaker() *circuitBreaker {
+	cb := &circuitBreaker{}
+	cb.cond = sync.NewCond(&cb.mu)
+
+	return cb
+}
+
+// probe identifies the request a reporter sends to check whether the server has recovered.
+type probe uint64
+
+// noProbe is the probe of requests sent while the circuit is closed.
+const noProbe probe = 0
+
+// wait blocks while the circuit is open. Once the open period has elapsed,
+// a single reporter is let through to probe the server and wait returns its probe.
+// The probe must be followed by record or abort.
+func (cb *circuitBreaker) wait() probe {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	for {
+		switch cb.state {
+		case breakerClosed:
+			return noProbe
+		case breakerOpen:
+			if time.Now().Before(cb.openUntil) {
+				cb.cond.Wait()
+				continue
+			}
+			cb.state = breakerHalfOpen
+			return cb.startProbe()
+		case breakerHalfOpen:
+			if cb.probe == noProbe {
+				return cb.startProbe()
+			}
+			cb.cond.Wait()
+		}
+	}
+}
+
+// startProbe must be called with cb.mu held.
+func (cb *circuitBreaker) startProbe() probe {
+	cb.probes++
+	cb.probe = cb.probes
+
+	return cb.probe
+}
+
+// abort gives up the probe of a reporter that did not send a request.
+func (cb *circuitBreaker) abort(p probe) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if p != noProbe && p == cb.probe {
+		cb.probe = noProbe
+		cb.cond.Broadcast()
+	}
+}
+
+// record updates the circuit with the result of a request sent with probe p.
+// Network errors, 429 and 5xx responses count as failures; any other response means the server is up.
+// Once the circuit is open, only the result of the probe changes it. The results of requests sent
+// before it opened are ignored, so that they do not extend the open period.
+func (cb *circuitBreaker) record(p probe, statusCode int, header http.Header, err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state != breakerClosed {
+		if p == noProbe || p != cb.probe {
+			return
+		}
+		cb.probe = noProbe
+		defer cb.cond.Broadcast()
+	}
+
+	if err == nil && statusCode != http.StatusTooManyRequests && statusCode < http.StatusInternalServerError {
+		if cb.state != breakerClosed {
+			log.Info().Msg("Alpacon has recovered, resuming reporters.")
+		}
+		cb.state = breakerClosed
+		cb.failures = 0
+		cb.backoff = 0
+		return
+	}
+
+	cb.failures++
+	retryAfter := parseRetryAfter(header)
+	// Retry-After is an explicit request from the server, so it opens the circuit right away.
+	if cb.state == breakerClosed && cb.failures < breakerThreshold && retryAfter == 0 {
+		return
+	}
+
+	if cb.backoff == 0 {
+		cb.backoff = breakerMinBackoff
+	} else {
+		cb.backoff *= 2
+	}
+	if cb.backoff > breakerMaxBackoff {
+		cb.backoff = breakerMaxBackoff
+	}
+
+	delay := cb.backoff
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	// spread the agents so that they do not come back all at once
+	delay += time.Duration(rand.Float64() * breakerJitter * float64(delay))
+
+	cb.state = breakerOpen
+	cb.openUntil = time.Now().Add(delay)
+	time.AfterFunc(delay, func() {
+		cb.mu.Lock()
+		defer cb.mu.Unlock()
+		cb.cond.Broadcast()
+	})
+
+	log.Warn().Msgf("Alpacon is unavailable (%d consecutive failures), pausing reporters for %s.",
+		cb.failures, delay.Round(time.Second))
+}
+
+func (cb *circuitBreaker) status() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.state.String()
+}
+
+// parseRetryAfter accepts both forms of the Retry-After header, delay-seconds and HTTP-date.
+func parseRetryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,246 @@
+package scheduler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expire ends the open period of the circuit right away.
+func expire(cb *circuitBreaker) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.openUntil = time.Now()
+	cb.cond.Broadcast()
+}
+
+// waitAsync calls wait in the background and returns its probe once it returns.
+func waitAsync(cb *circuitBreaker) <-chan probe {
+	done := make(chan probe, 1)
+	go func() { done <- cb.wait() }()
+
+	return done
+}
+
+// openBreaker opens a new circuit with breakerThreshold failures.
+func openBreaker() *circuitBreaker {
+	cb := newCircuitBreaker()
+	for i := 0; i < breakerThreshold; i++ {
+		cb.record(noProbe, http.StatusBadGateway, http.Header{}, nil)
+	}
+
+	return cb
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{"missing", "", 0},
+		{"seconds", "120", 2 * time.Minute},
+		{"zero", "0", 0},
+		{"negative", "-5", 0},
+		{"date", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), time.Hour},
+		{"past date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0},
+		{"invalid", "soon", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.value != "" {
+				header.Set("Retry-After", tt.value)
+			}
+			// the date form has a precision of a second
+			assert.InDelta(t, tt.want, parseRetryAfter(header), float64(time.Second))
+		})
+	}
+}
+
+func TestBreakerOpen(t *testing.T) {
+	cb := newCircuitBreaker()
+
+	for i := 1; i < breakerThreshold; i++ {
+		cb.record(noProbe, 0, nil, errors.New("connection refused"))
+		assert.Equal(t, "closed", cb.status())
+	}
+	// any other response resets the failures
+	cb.record(noProbe, http.StatusBadRequest, http.Header{}, nil)
+	assert.Zero(t, cb.failures)
+	assert.Equal(t, noProbe, cb.wait())
+
+	for i := 0; i < breakerThreshold; i++ {
+		cb.record(noProbe, http.StatusInternalServerError, http.Header{}, nil)
+	}
+	assert.Equal(t, "open", cb.status())
+	assert.Equal(t, breakerMinBackoff, cb.backoff)
+	assert.WithinDuration(t, time.Now().Add(breakerMinBackoff), cb.openUntil,
+		time.Duration(breakerJitter*float64(breakerMinBackoff))+time.Second)
+
+	done := waitAsync(cb)
+	assert.Never(t, func() bool { return len(done) > 0 }, 100*time.Millisecond, 10*time.Millisecond,
+		"reporters are paused while the circuit is open")
+	expire(cb)
+	select {
+	case p := <-done:
+		assert.NotEqual(t, noProbe, p)
+	case <-time.After(time.Second):
+		t.Fatal("wait did not return after the open period")
+	}
+	assert.Equal(t, "half-open", cb.status())
+}
+
+func TestBreakerRetryAfter(t *testing.T) {
+	cb := newCircuitBreaker()
+
+	// a single response asking to slow down opens the circuit for as long as asked
+	cb.record(noProbe, http.StatusTooManyRequests, http.Header{"Retry-After": {"60"}}, nil)
+	assert.Equal(t, "open", cb.status())
+	assert.True(t, cb.openUntil.After(time.Now().Add(59*time.Second)))
+	assert.True(t, cb.openUntil.Before(time.Now().Add(time.Duration((1+breakerJitter)*float64(time.Minute))+time.Second)))
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	cb := openBreaker()
+	expire(cb)
+
+	// a single reporter probes the server, the others wait for its result
+	first := cb.wait()
+	require.NotEqual(t, noProbe, first)
+	done := waitAsync(cb)
+	assert.Never(t, func() bool { return len(done) > 0 }, 100*time.Millisecond, 10*time.Millisecond)
+
+	// a failed probe opens the circuit again, for longer
+	cb.record(first, http.StatusBadGateway, http.Header{}, nil)
+	assert.Equal(t, "open", cb.status())
+	assert.Equal(t, 2*breakerMinBackoff, cb.backoff)
+	assert.Empty(t, done)
+
+	// an aborted probe lets the next reporter probe
+	expire(cb)
+	second := <-done
+	require.NotEqual(t, noProbe, second)
+	assert.NotEqual(t, first, second)
+	done = waitAsync(cb)
+	assert.Never(t, func() bool { return len(done) > 0 }, 100*time.Millisecond, 10*time.Millisecond)
+	cb.abort(first)
+	assert.Empty(t, done, "only the current probe can be aborted")
+	cb.abort(second)
+	third := <-done
+	require.NotEqual(t, noProbe, third)
+
+	// a successful probe closes the circuit and resumes everyone
+	done = waitAsync(cb)
+	cb.record(third, http.StatusCreated, http.Header{}, nil)
+	assert.Equal(t, noProbe, <-done)
+	assert.Equal(t, "closed", cb.status())
+	assert.Zero(t, cb.failures)
+	assert.Zero(t, cb.backoff)
+	assert.Equal(t, noProbe, cb.wait())
+}
+
+func TestBreakerConcurrentFailures(t *testing.T) {
+	cb := openBreaker()
+	openUntil := cb.openUntil
+
+	// requests sent before the circuit opened do not extend the open period
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cb.record(noProbe, http.StatusServiceUnavailable, http.Header{}, nil)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, "open", cb.status())
+	assert.Equal(t, breakerMinBackoff, cb.backoff)
+	assert.Equal(t, breakerThreshold, cb.failures)
+	assert.True(t, openUntil.Equal(cb.openUntil))
+
+	// nor do they decide the probe
+	expire(cb)
+	p := cb.wait()
+	require.NotEqual(t, noProbe, p)
+	cb.record(noProbe, http.StatusCreated, http.Header{}, nil)
+	cb.record(noProbe, http.StatusServiceUnavailable, http.Header{}, nil)
+	assert.Equal(t, "half-open", cb.status())
+	assert.Equal(t, breakerMinBackoff, cb.backoff)
+
+	// while the probe is in flight, nobody else probes
+	done := make(chan probe, 10)
+	for i := 0; i < 10; i++ {
+		go func() { done <- cb.wait() }()
+	}
+	assert.Never(t, func() bool { return len(done) > 0 }, 100*time.Millisecond, 10*time.Millisecond)
+
+	// a failed probe doubles the backoff once
+	cb.record(p, http.StatusServiceUnavailable, http.Header{}, nil)
+	assert.Equal(t, 2*breakerMinBackoff, cb.backoff)
+	cb.record(p, http.StatusServiceUnavailable, http.Header{}, nil)
+	assert.Equal(t, 2*breakerMinBackoff, cb.backoff, "a probe is recorded once")
+
+	// the next open period lets exactly one of the waiting reporters probe
+	expire(cb)
+	next := <-done
+	assert.NotEqual(t, noProbe, next)
+	assert.Never(t, func() bool { return len(done) > 0 }, 100*time.Millisecond, 10*time.Millisecond)
+	cb.record(next, http.StatusOK, http.Header{}, nil)
+	for i := 0; i < 9; i++ {
+		assert.Equal(t, noProbe, <-done)
+	}
+}
+
+func TestBreakerBackoffLimit(t *testing.T) {
+	cb := openBreaker()
+	for i := 0; i < 20; i++ {
+		expire(cb)
+		cb.record(cb.wait(), http.StatusServiceUnavailable, http.Header{}, nil)
+	}
+	assert.Equal(t, breakerMaxBackoff, cb.backoff)
+}
+
+func TestReporterWaitsForBreaker(t *testing.T) {
+	requests := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	defer func(url string) { config.GlobalSettings.ServerURL = url }(config.GlobalSettings.ServerURL)
+	config.GlobalSettings.ServerURL = server.URL
+	breaker = newCircuitBreaker()
+	newRequestQueue()
+
+	// the reporter waits for an entry while the circuit is closed
+	reporter := NewReporter(0, &Session{Client: server.Client()})
+	done := make(chan struct{})
+	go func() {
+		reporter.next()
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	breaker.record(noProbe, http.StatusServiceUnavailable, http.Header{"Retry-After": {"3600"}}, nil)
+	Rqueue.Post("/api/events/events/", "event", 10, time.Time{}, 0)
+	assert.Never(t, func() bool { return len(requests) > 0 }, 200*time.Millisecond, 10*time.Millisecond,
+		"the breaker has opened while the reporter was waiting for the entry")
+
+	expire(breaker)
+	select {
+	case <-requests:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the entry was not sent after the breaker closed")
+	}
+	<-done
+	assert.Equal(t, "closed", breaker.status())
+}
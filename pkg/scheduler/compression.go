@@ -0,0 +1,81 @@
+package scheduler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Bodies smaller than this are not worth the overhead of compression.
+const compressMinSize = 1024
+
+// negotiateCompression enables compression if it is configured and the server
+// lists the coding in the Accept-Encoding header of its response (RFC 7694).
+// Older servers do not send the header, so they keep receiving plain bodies.
+func (session *Session) negotiateCompression(header http.Header) {
+	coding := config.GlobalSettings.Compression
+	if coding == "" {
+		return
+	}
+
+	for _, value := range header.Values("Accept-Encoding") {
+		for _, accepted := range strings.Split(value, ",") {
+			accepted, _, _ = strings.Cut(accepted, ";")
+			if strings.EqualFold(strings.TrimSpace(accepted), coding) {
+				session.compress.Store(true)
+				log.Debug().Msgf("Alpacon accepts %s request bodies, enabling compression.", coding)
+				return
+			}
+		}
+	}
+
+	log.Info().Msgf("Alpacon does not accept %s request bodies, sending them uncompressed.", coding)
+}
+
+// CompressionEnabled reports whether request bodies are compressed.
+func (session *Session) CompressionEnabled() bool {
+	return session.compress.Load()
+}
+
+// shouldCompress only compresses requests to Alpacon, as other hosts never advertised support.
+func (session *Session) shouldCompress(req *http.Request) bool {
+	return session.compress.Load() &&
+		req.GetBody != nil &&
+		req.ContentLength >= compressMinSize &&
+		req.Header.Get("Content-Encoding") == "" &&
+		strings.HasPrefix(req.URL.String(), config.ActiveEndpoint().ServerURL)
+}
+
+func gzipRequest(req *http.Request) error {
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = body.Close() }()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err = io.Copy(zw, body)
+	if err != nil {
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+
+	data := buf.Bytes()
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	req.ContentLength = int64(len(data))
+	req.Header.Set("Content-Encoding", "gzip")
+
+	return nil
+}
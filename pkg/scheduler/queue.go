@@ -1,9 +1,11 @@
 package scheduler
 
 import (
+	"container/heap"
 	"github.com/adrianbrad/queue"
 	"github.com/rs/zerolog/log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -17,6 +19,14 @@ const (
 	MaxQueueSize = 10 * 60 * 60 // 10 entries/second * 1h
 )
 
+// defaultTTLs holds the time-to-live applied when a request is queued without one.
+// Keys are URL prefixes; realtime data is useless once it is this old.
+var defaultTTLs = map[string]time.Duration{
+	"/api/servers/servers/-/status/": 5 * time.Minute,
+	"/api/history/logs/":             1 * time.Hour,
+	"/api/metrics/":                  1 * time.Hour,
+}
+
 func newRequestQueue() {
 	Rqueue = &RequestQueue{
 		queue: queue.NewPriority(
@@ -24,7 +34,9 @@ func newRequestQueue() {
 			lessFunc,
 			queue.WithCapacity(MaxQueueSize),
 		),
-		cond: sync.NewCond(&sync.Mutex{}),
+		cond:    sync.NewCond(&sync.Mutex{}),
+		dues:    &dueTracker{heaps: make(map[int]*dueHeap)},
+		batcher: newBatcher(),
 	}
 }
 
@@ -36,44 +48,235 @@ func lessFunc(elem, otherElem PriorityEntry) bool {
 	return elem.priority < otherElem.priority
 }
 
-func (rq *RequestQueue) request(method, url string, data interface{}, priority int, due time.Time) {
+func (rq *RequestQueue) request(method, url string, data interface{}, priority int, due time.Time, ttl time.Duration) {
 	// time.Time{} : 0001-01-01 00:00:00 +0000 UTC
 	if due.IsZero() {
 		due = time.Now()
 	}
 
+	if ttl == 0 {
+		ttl = getDefaultTTL(url)
+	}
+
 	entry := PriorityEntry{
 		priority: priority,
 		method:   method,
 		url:      url,
 		data:     data,
 		due:      due,
-		// expiry:
-		retry: RetryLimit,
+		retry:    RetryLimit,
+	}
+	if ttl > 0 {
+		entry.expiry = due.Add(ttl)
+	}
+
+	if rq.spool != nil {
+		id, err := rq.spool.save(entry)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed to spool entry, keeping it in memory only: %s", entry.url)
+		}
+		entry.spoolID = id
+	}
+
+	if rule, ok := findBatchRule(method, url); ok {
+		rq.batch(entry, rule)
+		return
 	}
 
+	rq.enqueue(entry)
+}
+
+func (rq *RequestQueue) enqueue(entry PriorityEntry) {
 	// Do not wake reporter goroutine if the queue is full or uninitialized.
+	if !rq.offer(entry) {
+		log.Error().Msgf("Queue is full or uninitialized, dropping entry: %s", entry.url)
+		return
+	}
+
+	rq.cond.Signal()
+}
+
+// offer puts the entry into the in-memory queue.
+// If the queue is full, spooled entries stay on disk and are loaded again later.
+// It returns false if any part of the entry has been dropped.
+func (rq *RequestQueue) offer(entry PriorityEntry) bool {
 	err := rq.queue.Offer(entry)
+	if err == nil {
+		rq.dues.push(entry)
+		return true
+	}
+
+	if rq.spool == nil {
+		return false
+	}
+
+	kept := true
+	for _, part := range entry.parts() {
+		if part.spoolID == 0 {
+			kept = false
+			continue
+		}
+		rq.spool.unload(part)
+	}
+
+	return kept
+}
+
+// requeue puts an entry back for another attempt.
+func (rq *RequestQueue) requeue(entry PriorityEntry) bool {
+	if rq.spool != nil {
+		for _, part := range entry.parts() {
+			part.due = entry.due
+			part.retry = entry.retry
+			rq.spool.update(part)
+		}
+	}
+
+	return rq.offer(entry)
+}
+
+// release is called once an entry has been sent or dropped for good.
+func (rq *RequestQueue) release(entry PriorityEntry) {
+	if rq.spool != nil {
+		for _, part := range entry.parts() {
+			rq.spool.remove(part)
+		}
+	}
+}
+
+// evicted reports whether the entry has been evicted from the spool after it was loaded.
+// A merged entry is only dropped once all of its parts have been evicted.
+func (rq *RequestQueue) evicted(entry PriorityEntry) bool {
+	if rq.spool == nil {
+		return false
+	}
+
+	evicted := true
+	for _, part := range entry.parts() {
+		if !rq.spool.isEvicted(part) {
+			evicted = false
+		}
+	}
+
+	return evicted
+}
+
+// refill loads spooled entries into the in-memory queue, must be called with cond.L held.
+func (rq *RequestQueue) refill() bool {
+	if rq.spool == nil {
+		return false
+	}
+
+	entries := rq.spool.load()
+	for _, entry := range entries {
+		rq.offer(entry)
+	}
+
+	return len(entries) > 0
+}
+
+// get takes the next entry from the in-memory queue, must be called with cond.L held.
+func (rq *RequestQueue) get() (PriorityEntry, error) {
+	entry, err := rq.queue.Get()
 	if err != nil {
-		log.Error().Err(err).Msgf("Queue is full or uninitialized, dropping entry: %s", entry.url)
+		return entry, err
+	}
+	rq.dues.pop(entry)
+
+	return entry, nil
+}
+
+// dueTracker keeps the due times of queued entries to find the oldest one.
+// The queue always hands out the entry with the earliest due time within a priority,
+// so a min-heap per priority stays in sync with it without lazy deletion.
+type dueTracker struct {
+	mu    sync.Mutex
+	heaps map[int]*dueHeap
+}
+
+func (dt *dueTracker) push(entry PriorityEntry) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	h, ok := dt.heaps[entry.priority]
+	if !ok {
+		h = &dueHeap{}
+		dt.heaps[entry.priority] = h
+	}
+	heap.Push(h, entry.due)
+}
+
+func (dt *dueTracker) pop(entry PriorityEntry) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	h, ok := dt.heaps[entry.priority]
+	if !ok || h.Len() == 0 {
 		return
 	}
+	heap.Pop(h)
+}
 
-	rq.cond.Signal()
+func (dt *dueTracker) oldest() time.Time {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	var oldest time.Time
+	for _, h := range dt.heaps {
+		if h.Len() == 0 {
+			continue
+		}
+		if oldest.IsZero() || (*h)[0].Before(oldest) {
+			oldest = (*h)[0]
+		}
+	}
+
+	return oldest
+}
+
+type dueHeap []time.Time
+
+func (h dueHeap) Len() int           { return len(h) }
+func (h dueHeap) Less(i, j int) bool { return h[i].Before(h[j]) }
+func (h dueHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *dueHeap) Push(x any) {
+	*h = append(*h, x.(time.Time))
+}
+
+func (h *dueHeap) Pop() any {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+func getDefaultTTL(url string) time.Duration {
+	for prefix, ttl := range defaultTTLs {
+		if strings.HasPrefix(url, prefix) {
+			return ttl
+		}
+	}
+
+	return 0
 }
 
-func (rq *RequestQueue) Post(url string, data interface{}, priority int, due time.Time) {
-	rq.request(http.MethodPost, url, data, priority, due)
+// Post, Patch, Put and Delete queue a request to Alpacon.
+// The entry is dropped if it could not be sent within ttl after it became due.
+// A zero ttl applies the default for the URL, if any.
+func (rq *RequestQueue) Post(url string, data interface{}, priority int, due time.Time, ttl time.Duration) {
+	rq.request(http.MethodPost, url, data, priority, due, ttl)
 }
 
-func (rq *RequestQueue) Patch(url string, data interface{}, priority int, due time.Time) {
-	rq.request(http.MethodPatch, url, data, priority, due)
+func (rq *RequestQueue) Patch(url string, data interface{}, priority int, due time.Time, ttl time.Duration) {
+	rq.request(http.MethodPatch, url, data, priority, due, ttl)
 }
 
-func (rq *RequestQueue) Put(url string, data interface{}, priority int, due time.Time) {
-	rq.request(http.MethodPut, url, data, priority, due)
+func (rq *RequestQueue) Put(url string, data interface{}, priority int, due time.Time, ttl time.Duration) {
+	rq.request(http.MethodPut, url, data, priority, due, ttl)
 }
 
-func (rq *RequestQueue) Delete(url string, data interface{}, priority int, due time.Time) {
-	rq.request(http.MethodDelete, url, data, priority, due)
+func (rq *RequestQueue) Delete(url string, data interface{}, priority int, due time.Time, ttl time.Duration) {
+	rq.request(http.MethodDelete, url, data, priority, due, ttl)
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/alpacanetworks/alpamon/pkg/db/ent"
 	"github.com/alpacanetworks/alpamon/pkg/utils"
 	"github.com/alpacanetworks/alpamon/pkg/version"
 	"github.com/rs/zerolog/log"
@@ -17,6 +18,8 @@ const (
 	startUpEventURL = "/api/events/events/"
 )
 
+var reporters []*Reporter
+
 func NewReporter(index int, session *Session) *Reporter {
 	return &Reporter{
 		name:    fmt.Sprintf("Reporter-%d", index),
@@ -31,13 +34,23 @@ func NewReporter(index int, session *Session) *Reporter {
 	}
 }
 
-func StartReporters(session *Session) {
+func StartReporters(session *Session, client *ent.Client) {
 	newRequestQueue() // init RequestQueue
 
+	if config.GlobalSettings.UseSpool && client != nil {
+		spool, err := NewSpool(client, config.GlobalSettings.SpoolSize)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to open request spool, queued requests will not survive restarts.")
+		} else {
+			Rqueue.spool = spool
+		}
+	}
+
 	wg := sync.WaitGroup{}
 	for i := 0; i < config.GlobalSettings.HTTPThreads; i++ {
 		wg.Add(1)
 		reporter := NewReporter(i, session)
+		reporters = append(reporters, reporter)
 		go func() {
 			defer wg.Done()
 			reporter.Run()
@@ -54,16 +67,18 @@ func reportStartupEvent() {
 		"description": fmt.Sprintf("alpamon %s started running.", version.Version),
 	})
 
-	Rqueue.Post(startUpEventURL, eventData, 10, time.Time{})
+	Rqueue.Post(startUpEventURL, eventData, 10, time.Time{}, 0)
 }
 
-func (r *Reporter) query(entry PriorityEntry) {
+// query sends the entry. p is the probe of the breaker the request is sent with, if any.
+func (r *Reporter) query(entry PriorityEntry, p probe) {
 	t1 := time.Now()
-	resp, statusCode, err := r.session.Request(entry.method, entry.url, entry.data, 5)
+	resp, statusCode, header, err := r.session.requestWithHeader(entry.method, entry.url, entry.data, 5)
 	t2 := time.Now()
 
-	r.counters.delay = r.counters.delay*0.9 + (t2.Sub(entry.due).Seconds())*0.1
-	r.counters.latency = r.counters.latency*0.9 + (t2.Sub(t1).Seconds())*0.1
+	breaker.record(p, statusCode, header, err)
+
+	r.counters.updateTimes(t2.Sub(entry.due), t2.Sub(t1))
 
 	var success bool
 	if err != nil {
@@ -81,48 +96,164 @@ func (r *Reporter) query(entry PriorityEntry) {
 	}
 
 	if success {
-		r.counters.success++
-	} else {
-		r.counters.failure++
-		if entry.retry > 0 {
-			backoff := time.Duration(math.Pow(2, float64(RetryLimit-entry.retry))) * time.Second
-			entry.due = entry.due.Add(backoff)
-			entry.retry--
-			err = Rqueue.queue.Offer(entry)
-			if err != nil {
-				r.counters.ignored++
-			}
-		} else {
-			r.counters.ignored++
+		for range entry.parts() {
+			r.counters.incSuccess()
+		}
+		Rqueue.release(entry)
+		return
+	}
+
+	if entry.batch != nil && statusCode == http.StatusBadRequest {
+		// Retry the parts one by one so that a single invalid entry does not fail the whole batch.
+		for _, part := range entry.parts() {
+			r.counters.incFailure()
+			r.retry(part)
 		}
+		return
+	}
+
+	r.counters.incFailure()
+	r.retry(entry)
+}
+
+func (r *Reporter) retry(entry PriorityEntry) {
+	backoff := time.Duration(math.Pow(2, float64(RetryLimit-entry.retry))) * time.Second
+	// do not retry if the entry would expire before the next attempt
+	if entry.retry > 0 && (entry.expiry.IsZero() || entry.due.Add(backoff).Before(entry.expiry)) {
+		entry.due = entry.due.Add(backoff)
+		entry.retry--
+		if !Rqueue.requeue(entry) {
+			r.counters.incIgnored()
+		}
+	} else {
+		r.counters.incIgnored()
+		Rqueue.release(entry)
 	}
 }
 
 func (r *Reporter) Run() {
 	for {
-		Rqueue.cond.L.Lock()
-		for Rqueue.queue.Size() == 0 {
-			Rqueue.cond.Wait()
-		}
-		entry, err := Rqueue.queue.Get()
-		Rqueue.cond.L.Unlock()
-		if err != nil {
-			continue
-		}
+		r.next()
+	}
+}
 
-		if !entry.expiry.IsZero() && entry.expiry.Before(time.Now()) {
-			r.counters.ignored++
-		} else if !entry.due.IsZero() && entry.due.After(time.Now()) {
-			err = Rqueue.queue.Offer(entry)
-			if err != nil {
-				r.counters.ignored++
-			}
-			time.Sleep(1 * time.Second)
-		} else {
-			r.query(entry)
+// next waits for an entry and handles it.
+func (r *Reporter) next() {
+	Rqueue.cond.L.Lock()
+	for Rqueue.queue.Size() == 0 && !Rqueue.refill() {
+		Rqueue.cond.Wait()
+	}
+	Rqueue.cond.L.Unlock()
+
+	// all reporters are paused while the circuit breaker is open. It is checked once there is
+	// an entry, as it may have opened while waiting for one. The entry may be taken by another
+	// reporter meanwhile, then get fails and the probe is given up.
+	p := breaker.wait()
+
+	Rqueue.cond.L.Lock()
+	entry, err := Rqueue.get()
+	Rqueue.cond.L.Unlock()
+
+	if err != nil || !r.handle(entry, p) {
+		breaker.abort(p)
+	}
+}
+
+// handle sends the entry if it is due and returns whether a request has been made.
+func (r *Reporter) handle(entry PriorityEntry, p probe) bool {
+	if Rqueue.evicted(entry) {
+		r.counters.incIgnored()
+	} else if !entry.expiry.IsZero() && entry.expiry.Before(time.Now()) {
+		r.counters.incIgnored()
+		Rqueue.release(entry)
+	} else if !entry.due.IsZero() && entry.due.After(time.Now()) {
+		if !Rqueue.offer(entry) {
+			r.counters.incIgnored()
 		}
+		time.Sleep(1 * time.Second)
+	} else {
+		r.query(entry, p)
+		return true
+	}
+
+	return false
+}
+
+func (r *Reporter) Stats() ReporterStats {
+	r.counters.mu.Lock()
+	defer r.counters.mu.Unlock()
+
+	return ReporterStats{
+		Name:    r.name,
+		Success: r.counters.success,
+		Failure: r.counters.failure,
+		Ignored: r.counters.ignored,
+		Delay:   r.counters.delay,
+		Latency: r.counters.latency,
 	}
 }
 
-// TODO : GetReporterStats
-func GetReporterStats() {}
+// GetReporterStats returns the counters of every reporter, their totals and the queue state.
+// Delay and latency of the total are averaged over the reporters.
+func GetReporterStats() Stats {
+	stats := Stats{
+		Reporters: []ReporterStats{},
+		Total:     ReporterStats{Name: "Total"},
+	}
+
+	for _, reporter := range reporters {
+		rs := reporter.Stats()
+		stats.Reporters = append(stats.Reporters, rs)
+		stats.Total.Success += rs.Success
+		stats.Total.Failure += rs.Failure
+		stats.Total.Ignored += rs.Ignored
+		stats.Total.Delay += rs.Delay
+		stats.Total.Latency += rs.Latency
+	}
+
+	stats.Circuit = breaker.status()
+
+	if len(stats.Reporters) > 0 {
+		stats.Total.Delay /= float64(len(stats.Reporters))
+		stats.Total.Latency /= float64(len(stats.Reporters))
+	}
+
+	if Rqueue == nil {
+		return stats
+	}
+
+	stats.QueueSize = Rqueue.queue.Size()
+	if Rqueue.spool != nil {
+		stats.SpoolSize = Rqueue.spool.count()
+	}
+	if oldest := Rqueue.dues.oldest(); !oldest.IsZero() {
+		stats.OldestDue = &oldest
+	}
+
+	return stats
+}
+
+func (c *counters) incSuccess() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.success++
+}
+
+func (c *counters) incFailure() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failure++
+}
+
+func (c *counters) incIgnored() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ignored++
+}
+
+func (c *counters) updateTimes(delay, latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.delay = c.delay*0.9 + delay.Seconds()*0.1
+	c.latency = c.latency*0.9 + latency.Seconds()*0.1
+}
@@ -3,11 +3,10 @@ package scheduler
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"os"
 	"strings"
@@ -21,39 +20,66 @@ import (
 const (
 	checkSessionURL = "/api/servers/servers/-/"
 	MaxRetryTimeout = 3 * 24 * time.Hour
+
+	// retries are spread by this fraction of the interval so that agents do not reconnect at once
+	connectJitter = 0.5
 )
 
 func InitSession() *Session {
-	session := &Session{
-		BaseURL: config.GlobalSettings.ServerURL,
-	}
+	session := &Session{}
 
 	client := http.Client{}
 
-	tlsConfig := &tls.Config{}
-	if config.GlobalSettings.CaCert != "" {
-		caCertPool := x509.NewCertPool()
-		caCert, err := os.ReadFile(config.GlobalSettings.CaCert)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to read CA certificate.")
-		}
-		caCertPool.AppendCertsFromPEM(caCert)
-		tlsConfig.RootCAs = caCertPool
+	transport, err := utils.NewTransport()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load TLS or proxy configuration.")
 	}
 
-	tlsConfig.InsecureSkipVerify = !config.GlobalSettings.SSLVerify
-	client.Transport = &http.Transport{
-		TLSClientConfig: tlsConfig,
-	}
+	client.Transport = transport
 
 	session.Client = &client
-	session.Authorization = fmt.Sprintf(`id="%s", key="%s"`, config.GlobalSettings.ID, config.GlobalSettings.Key)
+	session.Authorization = fmt.Sprintf(`id="%s", key="%s"`, config.GlobalSettings.ID, config.ServerKey())
 
 	return session
 }
 
+func (session *Session) authorization() string {
+	session.authMu.RLock()
+	defer session.authMu.RUnlock()
+
+	return session.Authorization
+}
+
+// SetKey changes the credentials of the session, e.g. after the key has been rotated.
+func (session *Session) SetKey(id, key string) {
+	session.authMu.Lock()
+	defer session.authMu.Unlock()
+
+	session.Authorization = fmt.Sprintf(`id="%s", key="%s"`, id, key)
+}
+
+// CheckKey verifies that the server accepts the given key, without changing the session.
+func (session *Session) CheckKey(id, key string) error {
+	req, err := session.newRequest(http.MethodGet, checkSessionURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(`id="%s", key="%s"`, id, key))
+
+	_, statusCode, err := session.do(req, 5)
+	if err != nil {
+		return err
+	}
+	if statusCode != http.StatusOK {
+		return fmt.Errorf("server responded with %d", statusCode)
+	}
+
+	return nil
+}
+
 func (session *Session) CheckSession(ctx context.Context) bool {
 	timeout := 0 * time.Second
+	wait := timeout
 	ctxWithTimeout, cancel := context.WithTimeout(ctx, MaxRetryTimeout)
 	defer cancel()
 
@@ -62,17 +88,22 @@ func (session *Session) CheckSession(ctx context.Context) bool {
 		case <-ctxWithTimeout.Done():
 			log.Error().Msg("Session check cancelled or timed out.")
 			os.Exit(1)
-		case <-time.After(timeout):
-			resp, statusCode, err := session.Get(checkSessionURL, 5)
+		case <-time.After(wait):
+			serverURL := config.ActiveEndpoint().ServerURL
+			resp, statusCode, header, err := session.requestWithHeader(http.MethodGet, checkSessionURL, nil, 5)
 			if err != nil || statusCode != http.StatusOK {
-				log.Debug().Err(err).Msgf("Failed to connect to %s, will try again in %ds.", config.GlobalSettings.ServerURL, int(timeout.Seconds()))
+				log.Debug().Err(err).Msgf("Failed to connect to %s, will try again in %ds.", serverURL, int(timeout.Seconds()))
+				config.EndpointFailed(serverURL)
 			} else {
+				config.EndpointSucceeded(serverURL)
 				var response map[string]interface{}
 				err = json.Unmarshal(resp, &response)
 				if err != nil {
 					log.Debug().Err(err).Msgf("Failed to unmarshal JSON, will try again in %ds.", int(timeout.Seconds()))
 				} else {
 					if commissioned, ok := response["commissioned"].(bool); ok {
+						session.negotiateCompression(header)
+						negotiateBulk(header)
 						return commissioned
 					}
 				}
@@ -84,10 +115,29 @@ func (session *Session) CheckSession(ctx context.Context) bool {
 			if timeout > config.MaxConnectInterval {
 				timeout = config.MaxConnectInterval
 			}
+			wait = timeout + time.Duration((rand.Float64()*2-1)*connectJitter*float64(timeout))
 		}
 	}
 }
 
+// Probe checks whether serverURL, e.g. the primary endpoint while failed over, accepts the session.
+func (session *Session) Probe(serverURL string) error {
+	req, err := http.NewRequest(http.MethodGet, utils.JoinPath(serverURL, checkSessionURL), nil)
+	if err != nil {
+		return err
+	}
+
+	_, statusCode, err := session.do(req, 5)
+	if err != nil {
+		return err
+	}
+	if statusCode != http.StatusOK {
+		return fmt.Errorf("server responded with %d", statusCode)
+	}
+
+	return nil
+}
+
 func (session *Session) newRequest(method, url string, rawBody interface{}) (*http.Request, error) {
 	var body io.Reader
 	if rawBody != nil {
@@ -105,35 +155,76 @@ func (session *Session) newRequest(method, url string, rawBody interface{}) (*ht
 		}
 	}
 
-	return http.NewRequest(method, utils.JoinPath(session.BaseURL, url), body)
+	return http.NewRequest(method, utils.JoinPath(config.ActiveEndpoint().ServerURL, url), body)
 }
 
 func (session *Session) do(req *http.Request, timeout time.Duration) ([]byte, int, error) {
+	body, statusCode, _, err := session.send(req, timeout)
+
+	return body, statusCode, err
+}
+
+// send is like do, but also returns the response header.
+func (session *Session) send(req *http.Request, timeout time.Duration) ([]byte, int, http.Header, error) {
 	ctx, cancel := context.WithTimeout(req.Context(), timeout*time.Second)
 	defer cancel()
 
 	req = req.WithContext(ctx)
 
-	req.Header.Set("Authorization", session.Authorization)
+	if req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", session.authorization())
+	}
 	req.Header.Set("User-Agent", utils.GetUserAgent("alpamon"))
 
-	if req.Method == http.MethodPost || req.Method == http.MethodPut || req.Method == http.MethodPatch {
+	if req.Header.Get("Content-Type") == "" &&
+		(req.Method == http.MethodPost || req.Method == http.MethodPut || req.Method == http.MethodPatch) {
 		req.Header.Set("Content-Type", "application/json")
 	}
 
+	getBody, contentLength := req.GetBody, req.ContentLength
+	compressed := false
+	if session.shouldCompress(req) {
+		err := gzipRequest(req)
+		if err != nil {
+			log.Debug().Err(err).Msg("Failed to compress request body, sending it as is.")
+		} else {
+			compressed = true
+		}
+	}
+
 	resp, err := session.Client.Do(req)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, nil, err
+	}
+
+	// The server does not accept compressed bodies after all, send it again without compression.
+	if compressed && resp.StatusCode == http.StatusUnsupportedMediaType {
+		_ = resp.Body.Close()
+		session.compress.Store(false)
+		log.Warn().Msg("Alpacon does not accept compressed request bodies, disabling compression.")
+
+		req.Body, err = getBody()
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		req.GetBody = getBody
+		req.ContentLength = contentLength
+		req.Header.Del("Content-Encoding")
+
+		resp, err = session.Client.Do(req)
+		if err != nil {
+			return nil, 0, nil, err
+		}
 	}
 
 	defer func() { _ = resp.Body.Close() }()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, resp.StatusCode, err
+		return nil, resp.StatusCode, resp.Header, err
 	}
 
-	return body, resp.StatusCode, nil
+	return body, resp.StatusCode, resp.Header, nil
 }
 
 func (session *Session) Request(method, url string, rawBody interface{}, timeout time.Duration) ([]byte, int, error) {
@@ -150,6 +241,15 @@ func (session *Session) Request(method, url string, rawBody interface{}, timeout
 	return resp, statusCode, nil
 }
 
+func (session *Session) requestWithHeader(method, url string, rawBody interface{}, timeout time.Duration) ([]byte, int, http.Header, error) {
+	req, err := session.newRequest(method, url, rawBody)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	return session.send(req, timeout)
+}
+
 func (session *Session) Get(url string, timeout time.Duration) ([]byte, int, error) {
 	req, err := session.newRequest(http.MethodGet, url, nil)
 	if err != nil {
@@ -186,32 +286,23 @@ func (session *Session) Patch(url string, rawBody interface{}, timeout time.Dura
 	return session.do(req, timeout)
 }
 
-func (session *Session) MultipartRequest(url string, body bytes.Buffer, contentType string, timeout time.Duration) ([]byte, int, error) {
-	req, err := http.NewRequest(http.MethodPost, url, &body)
+// MultipartRequest posts a multipart body of contentLength bytes. getBody is called for every
+// send of the body, so that it can be compressed and sent again, and may stream it from a file.
+func (session *Session) MultipartRequest(url string, getBody func() (io.ReadCloser, error), contentLength int64, contentType string, timeout time.Duration) ([]byte, int, error) {
+	body, err := getBody()
 	if err != nil {
 		return nil, 0, err
 	}
 
-	ctx, cancel := context.WithTimeout(req.Context(), timeout*time.Second)
-	defer cancel()
-
-	req = req.WithContext(ctx)
-
-	req.Header.Set("Authorization", session.Authorization)
-	req.Header.Set("User-Agent", utils.GetUserAgent("alpamon"))
-	req.Header.Set("Content-Type", contentType)
-
-	resp, err := session.Client.Do(req)
+	req, err := http.NewRequest(http.MethodPost, url, body)
 	if err != nil {
+		_ = body.Close()
 		return nil, 0, err
 	}
+	req.GetBody = getBody
+	req.ContentLength = contentLength
 
-	defer func() { _ = resp.Body.Close() }()
-
-	responseBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, resp.StatusCode, err
-	}
+	req.Header.Set("Content-Type", contentType)
 
-	return responseBody, resp.StatusCode, nil
+	return session.do(req, timeout)
 }
@@ -0,0 +1,256 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/alpacanetworks/alpamon/pkg/db/ent"
+	"github.com/alpacanetworks/alpamon/pkg/db/ent/spoolentry"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	spoolLoadSize = 1000
+	spoolTimeout  = 5 * time.Second
+)
+
+var errSpoolFull = errors.New("spool is full of higher priority entries")
+
+// NewSpool persists queued requests in the local database so they survive restarts.
+// Entries left from a previous run are loaded by the reporters once they start.
+func NewSpool(client *ent.Client, maxSize int) (*Spool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), spoolTimeout)
+	defer cancel()
+
+	size, err := client.SpoolEntry.Query().Count(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if size > 0 {
+		log.Info().Msgf("Found %d spooled requests, replaying them.", size)
+	}
+
+	return &Spool{
+		client:   client,
+		maxSize:  maxSize,
+		size:     size,
+		loaded:   make(map[int]struct{}),
+		evicted:  make(map[int]struct{}),
+		overflow: size > 0,
+	}, nil
+}
+
+// save persists the entry and returns its row ID.
+// When the spool is full, the oldest entry with the lowest priority is evicted
+// unless every spooled entry is more important than the new one.
+func (s *Spool) save(entry PriorityEntry) (int, error) {
+	data, err := marshalData(entry.data)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), spoolTimeout)
+	defer cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size >= s.maxSize {
+		err = s.evict(ctx, entry.priority)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	create := s.client.SpoolEntry.Create().
+		SetPriority(entry.priority).
+		SetMethod(entry.method).
+		SetURL(entry.url).
+		SetData(data).
+		SetDue(entry.due).
+		SetRetry(entry.retry)
+	if !entry.expiry.IsZero() {
+		create.SetExpiry(entry.expiry)
+	}
+
+	row, err := create.Save(ctx)
+	if err != nil {
+		return 0, err
+	}
+	s.size++
+	s.loaded[row.ID] = struct{}{}
+
+	return row.ID, nil
+}
+
+// evict must be called with s.mu held.
+func (s *Spool) evict(ctx context.Context, priority int) error {
+	victim, err := s.client.SpoolEntry.Query().
+		Order(ent.Desc(spoolentry.FieldPriority), ent.Asc(spoolentry.FieldDue), ent.Asc(spoolentry.FieldID)).
+		First(ctx)
+	if err != nil {
+		return err
+	}
+
+	// lower number means higher priority
+	if victim.Priority < priority {
+		return errSpoolFull
+	}
+
+	err = s.client.SpoolEntry.DeleteOneID(victim.ID).Exec(ctx)
+	if err != nil {
+		return err
+	}
+	s.size--
+
+	if _, ok := s.loaded[victim.ID]; ok {
+		s.evicted[victim.ID] = struct{}{}
+	}
+	log.Warn().Msgf("Spool is full, evicted entry: %s %s", victim.Method, victim.URL)
+
+	return nil
+}
+
+// update stores the retry state of an entry that is going to be requeued.
+func (s *Spool) update(entry PriorityEntry) {
+	if entry.spoolID == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), spoolTimeout)
+	defer cancel()
+
+	err := s.client.SpoolEntry.UpdateOneID(entry.spoolID).
+		SetDue(entry.due).
+		SetRetry(entry.retry).
+		Exec(ctx)
+	if err != nil && !ent.IsNotFound(err) {
+		log.Debug().Err(err).Msgf("Failed to update spooled entry: %s", entry.url)
+	}
+}
+
+// remove deletes an entry that has been sent or dropped.
+func (s *Spool) remove(entry PriorityEntry) {
+	if entry.spoolID == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), spoolTimeout)
+	defer cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loaded, entry.spoolID)
+	delete(s.evicted, entry.spoolID)
+
+	n, err := s.client.SpoolEntry.Delete().Where(spoolentry.ID(entry.spoolID)).Exec(ctx)
+	if err != nil {
+		log.Debug().Err(err).Msgf("Failed to remove spooled entry: %s", entry.url)
+		return
+	}
+	s.size -= n
+}
+
+// unload keeps an entry in the spool only, e.g. when the in-memory queue is full.
+// It will be loaded again once the queue drains.
+func (s *Spool) unload(entry PriorityEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loaded, entry.spoolID)
+	s.overflow = true
+}
+
+// isEvicted reports whether the entry was evicted while it was loaded, and forgets it.
+func (s *Spool) isEvicted(entry PriorityEntry) bool {
+	if entry.spoolID == 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.evicted[entry.spoolID]; !ok {
+		return false
+	}
+	delete(s.evicted, entry.spoolID)
+	delete(s.loaded, entry.spoolID)
+
+	return true
+}
+
+// load returns spooled entries that are not held in memory, in priority/due order.
+func (s *Spool) load() []PriorityEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.overflow {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), spoolTimeout)
+	defer cancel()
+
+	loadedIDs := make([]int, 0, len(s.loaded))
+	for id := range s.loaded {
+		loadedIDs = append(loadedIDs, id)
+	}
+
+	rows, err := s.client.SpoolEntry.Query().
+		Where(spoolentry.IDNotIn(loadedIDs...)).
+		Order(ent.Asc(spoolentry.FieldPriority), ent.Asc(spoolentry.FieldDue)).
+		Limit(spoolLoadSize).
+		All(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load spooled entries.")
+		return nil
+	}
+
+	if len(rows) < spoolLoadSize {
+		s.overflow = false
+	}
+
+	entries := make([]PriorityEntry, 0, len(rows))
+	for _, row := range rows {
+		entry := PriorityEntry{
+			priority: row.Priority,
+			method:   row.Method,
+			url:      row.URL,
+			due:      row.Due,
+			expiry:   row.Expiry,
+			retry:    row.Retry,
+			spoolID:  row.ID,
+		}
+		if len(row.Data) > 0 {
+			entry.data = row.Data
+		}
+		entries = append(entries, entry)
+		s.loaded[row.ID] = struct{}{}
+	}
+
+	return entries
+}
+
+func (s *Spool) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+func marshalData(data interface{}) ([]byte, error) {
+	switch v := data.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	default:
+		return json.Marshal(v)
+	}
+}
@@ -0,0 +1,187 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"entgo.io/ent/dialect"
+	entsql "entgo.io/ent/dialect/sql"
+	"github.com/alpacanetworks/alpamon/pkg/config"
+	"github.com/alpacanetworks/alpamon/pkg/db/ent"
+	_ "github.com/glebarez/go-sqlite"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient returns an ent client of an in-memory database with the current schema,
+// private to the test.
+func newTestClient(t *testing.T) *ent.Client {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?mode=memory&cache=shared&_pragma=foreign_keys(1)", t.Name()))
+	require.NoError(t, err)
+	// the database is dropped with its last connection
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(0)
+
+	client := ent.NewClient(ent.Driver(entsql.OpenDB(dialect.SQLite, db)))
+	t.Cleanup(func() { _ = client.Close() })
+	require.NoError(t, client.Schema.Create(context.Background()))
+
+	return client
+}
+
+// newTestQueue replaces Rqueue with an empty queue spooled to client.
+func newTestQueue(t *testing.T, client *ent.Client) *Spool {
+	newRequestQueue()
+	spool, err := NewSpool(client, 100)
+	require.NoError(t, err)
+	Rqueue.spool = spool
+
+	return spool
+}
+
+func TestSpoolPersist(t *testing.T) {
+	client := newTestClient(t)
+	spool := newTestQueue(t, client)
+
+	due := time.Now().Add(time.Minute).Truncate(time.Second)
+	Rqueue.Post("/api/events/events/", map[string]string{"record": "started"}, 10, due, time.Hour)
+
+	assert.Equal(t, 1, spool.count())
+	row, err := client.SpoolEntry.Query().Only(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, http.MethodPost, row.Method)
+	assert.Equal(t, "/api/events/events/", row.URL)
+	assert.JSONEq(t, `{"record": "started"}`, string(row.Data))
+	assert.Equal(t, 10, row.Priority)
+	assert.Equal(t, RetryLimit, row.Retry)
+	assert.True(t, due.Equal(row.Due))
+	assert.True(t, due.Add(time.Hour).Equal(row.Expiry))
+}
+
+func TestSpoolReload(t *testing.T) {
+	client := newTestClient(t)
+	newTestQueue(t, client)
+
+	now := time.Now().Truncate(time.Second)
+	Rqueue.Post("/low/", "low", 20, now, -1)
+	Rqueue.Post("/later/", "later", 10, now.Add(time.Minute), -1)
+	Rqueue.Post("/first/", "first", 10, now, time.Hour)
+
+	// a new process finds the entries of the previous one
+	spool, err := NewSpool(client, 100)
+	require.NoError(t, err)
+	assert.Equal(t, 3, spool.count())
+
+	entries := spool.load()
+	require.Len(t, entries, 3)
+	var urls []string
+	for _, entry := range entries {
+		urls = append(urls, entry.url)
+		assert.NotZero(t, entry.spoolID)
+	}
+	assert.Equal(t, []string{"/first/", "/later/", "/low/"}, urls)
+	assert.Equal(t, []byte("first"), entries[0].data)
+	assert.True(t, now.Add(time.Hour).Equal(entries[0].expiry))
+	assert.True(t, entries[2].expiry.IsZero())
+
+	// loaded entries are not handed out twice
+	assert.Empty(t, spool.load())
+}
+
+func TestSpoolEviction(t *testing.T) {
+	client := newTestClient(t)
+	newRequestQueue()
+	spool, err := NewSpool(client, 2)
+	require.NoError(t, err)
+
+	now := time.Now()
+	_, err = spool.save(PriorityEntry{priority: 10, method: http.MethodPost, url: "/old/", due: now})
+	require.NoError(t, err)
+	_, err = spool.save(PriorityEntry{priority: 10, method: http.MethodPost, url: "/new/", due: now.Add(time.Second)})
+	require.NoError(t, err)
+
+	// the oldest entry of the lowest priority makes room
+	_, err = spool.save(PriorityEntry{priority: 1, method: http.MethodPost, url: "/urgent/", due: now})
+	require.NoError(t, err)
+	assert.Equal(t, 2, spool.count())
+	assert.False(t, spoolHas(t, client, "/old/"))
+	assert.True(t, spoolHas(t, client, "/new/"))
+	assert.True(t, spoolHas(t, client, "/urgent/"))
+
+	// nothing is evicted for a less important entry
+	_, err = spool.save(PriorityEntry{priority: 90, method: http.MethodPost, url: "/minor/", due: now})
+	assert.ErrorIs(t, err, errSpoolFull)
+}
+
+func TestSpoolExpiry(t *testing.T) {
+	client := newTestClient(t)
+	spool := newTestQueue(t, client)
+
+	Rqueue.Post("/api/metrics/", "stale", 10, time.Now().Add(-2*time.Hour), time.Hour)
+	require.Equal(t, 1, spool.count())
+
+	Rqueue.cond.L.Lock()
+	entry, err := Rqueue.get()
+	Rqueue.cond.L.Unlock()
+	require.NoError(t, err)
+
+	reporter := NewReporter(0, nil)
+	assert.False(t, reporter.handle(entry, noProbe), "an expired entry must not be sent")
+	assert.Equal(t, 1, reporter.Stats().Ignored)
+	assert.Equal(t, 0, spool.count())
+	assert.Equal(t, 0, client.SpoolEntry.Query().CountX(context.Background()))
+}
+
+func TestSpoolDeleteOnSuccess(t *testing.T) {
+	statusCode := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statusCode)
+	}))
+	defer server.Close()
+	defer func(url string) { config.GlobalSettings.ServerURL = url }(config.GlobalSettings.ServerURL)
+	config.GlobalSettings.ServerURL = server.URL
+	breaker = newCircuitBreaker()
+
+	client := newTestClient(t)
+	spool := newTestQueue(t, client)
+	reporter := NewReporter(0, &Session{Client: server.Client()})
+
+	Rqueue.Post("/api/events/events/", "event", 10, time.Time{}, 0)
+	Rqueue.cond.L.Lock()
+	entry, err := Rqueue.get()
+	Rqueue.cond.L.Unlock()
+	require.NoError(t, err)
+
+	// a failed request stays spooled with its retry state
+	reporter.query(entry, noProbe)
+	assert.Equal(t, 1, spool.count())
+	row := client.SpoolEntry.Query().OnlyX(context.Background())
+	assert.Equal(t, RetryLimit-1, row.Retry)
+	assert.True(t, row.Due.After(entry.due))
+
+	statusCode = http.StatusCreated
+	Rqueue.cond.L.Lock()
+	entry, err = Rqueue.get()
+	Rqueue.cond.L.Unlock()
+	require.NoError(t, err)
+
+	reporter.query(entry, noProbe)
+	assert.Equal(t, 0, spool.count())
+	assert.Equal(t, 0, client.SpoolEntry.Query().CountX(context.Background()))
+}
+
+func spoolHas(t *testing.T, client *ent.Client, url string) bool {
+	rows, err := client.SpoolEntry.Query().All(context.Background())
+	require.NoError(t, err)
+	for _, row := range rows {
+		if row.URL == url {
+			return true
+		}
+	}
+	return false
+}
@@ -2,15 +2,18 @@ package scheduler
 
 import (
 	"github.com/adrianbrad/queue"
+	"github.com/alpacanetworks/alpamon/pkg/db/ent"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Session struct {
-	BaseURL       string
 	Client        *http.Client
 	Authorization string
+	authMu        sync.RWMutex // guards Authorization once the session is shared
+	compress      atomic.Bool  // request bodies are gzipped, once the server has advertised support
 }
 
 // queue //
@@ -22,11 +25,27 @@ type PriorityEntry struct {
 	due      time.Time
 	expiry   time.Time
 	retry    int
+	spoolID  int              // 0 if the entry is not persisted in the spool
+	batch    *[]PriorityEntry // parts of a merged entry, a pointer to keep the entry comparable
 }
 
 type RequestQueue struct {
-	queue *queue.Priority[PriorityEntry]
-	cond  *sync.Cond
+	queue   *queue.Priority[PriorityEntry]
+	cond    *sync.Cond
+	spool   *Spool
+	dues    *dueTracker
+	batcher *batcher
+}
+
+// spool //
+type Spool struct {
+	client   *ent.Client
+	maxSize  int
+	size     int
+	mu       sync.Mutex
+	loaded   map[int]struct{} // rows currently held by the in-memory queue or a reporter
+	evicted  map[int]struct{} // loaded rows that were evicted and must be skipped
+	overflow bool             // some rows are persisted but not loaded in memory
 }
 
 // reporter //
@@ -36,10 +55,43 @@ type Reporter struct {
 	counters *counters
 }
 
+// breaker //
+type circuitBreaker struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	state     breakerState
+	failures  int // consecutive failures
+	backoff   time.Duration
+	openUntil time.Time
+	probe     probe // the request checking whether the server has recovered, if any
+	probes    probe // the last probe handed out
+}
+
 type counters struct {
+	mu      sync.Mutex
 	success int
 	failure int
 	ignored int
 	delay   float64
 	latency float64
 }
+
+// ReporterStats is a snapshot of the counters of a single reporter.
+type ReporterStats struct {
+	Name    string  `json:"name"`
+	Success int     `json:"success"`
+	Failure int     `json:"failure"`
+	Ignored int     `json:"ignored"`
+	Delay   float64 `json:"delay"`
+	Latency float64 `json:"latency"`
+}
+
+// Stats aggregates the state of all reporters and the request queue.
+type Stats struct {
+	Reporters []ReporterStats `json:"reporters"`
+	Total     ReporterStats   `json:"total"`
+	QueueSize int             `json:"queue_size"`
+	SpoolSize int             `json:"spool_size"`
+	OldestDue *time.Time      `json:"oldest_due"`
+	Circuit   string          `json:"circuit"`
+}
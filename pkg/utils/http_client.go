@@ -2,17 +2,52 @@ package utils
 
 import (
 	"bytes"
-	"crypto/tls"
-	"crypto/x509"
 	"io"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/alpacanetworks/alpamon/pkg/config"
-	"github.com/rs/zerolog/log"
+	"github.com/gorilla/websocket"
 )
 
+// NewTransport returns an HTTP transport for connections to Alpacon with the TLS and proxy settings applied.
+func NewTransport() (*http.Transport, error) {
+	tlsConfig, err := NewTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := NewProxyFunc(config.GlobalSettings.ProxyURL, config.GlobalSettings.ProxyUsername,
+		config.GlobalSettings.ProxyPassword, config.GlobalSettings.NoProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Transport{
+		Proxy:           proxy,
+		TLSClientConfig: tlsConfig,
+	}, nil
+}
+
+// NewDialer returns a websocket dialer with the TLS and proxy settings applied.
+func NewDialer() (*websocket.Dialer, error) {
+	tlsConfig, err := NewTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := NewProxyFunc(config.GlobalSettings.ProxyURL, config.GlobalSettings.ProxyUsername,
+		config.GlobalSettings.ProxyPassword, config.GlobalSettings.NoProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &websocket.Dialer{
+		Proxy:           proxy,
+		TLSClientConfig: tlsConfig,
+	}, nil
+}
+
 func Put(url string, body bytes.Buffer, timeout time.Duration) ([]byte, int, error) {
 	req, err := http.NewRequest(http.MethodPut, url, &body)
 	if err != nil {
@@ -21,20 +56,9 @@ func Put(url string, body bytes.Buffer, timeout time.Duration) ([]byte, int, err
 
 	client := &http.Client{Timeout: timeout}
 
-	tlsConfig := &tls.Config{}
-	if config.GlobalSettings.CaCert != "" {
-		caCertPool := x509.NewCertPool()
-		caCert, err := os.ReadFile(config.GlobalSettings.CaCert)
-		if err != nil {
-			log.Error().Err(err).Msg("Failed to read CA certificate.")
-		}
-		caCertPool.AppendCertsFromPEM(caCert)
-		tlsConfig.RootCAs = caCertPool
-	}
-
-	tlsConfig.InsecureSkipVerify = !config.GlobalSettings.SSLVerify
-	client.Transport = &http.Transport{
-		TLSClientConfig: tlsConfig,
+	client.Transport, err = NewTransport()
+	if err != nil {
+		return nil, 0, err
 	}
 
 	resp, err := client.Do(req)
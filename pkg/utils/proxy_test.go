@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUseProxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		noProxy string
+		proxied bool
+	}{
+		{"empty", "https://alpacon.io", "", true},
+		{"exact host", "https://alpacon.io", "alpacon.io", false},
+		{"case insensitive", "https://Alpacon.IO", "ALPACON.io", false},
+		{"subdomain", "https://api.alpacon.io", "alpacon.io", false},
+		{"dot suffix", "https://api.alpacon.io", ".alpacon.io", false},
+		{"dot suffix matches domain", "https://alpacon.io", ".alpacon.io", false},
+		{"wildcard suffix", "https://api.alpacon.io", "*.alpacon.io", false},
+		{"partial label", "https://notalpacon.io", "alpacon.io", true},
+		{"other host", "https://example.com", "alpacon.io, .internal", true},
+		{"list", "https://db.internal", "alpacon.io, .internal", false},
+		{"spaces and empty entries", "https://db.internal", " , alpacon.io ,, internal ", false},
+		{"port", "https://alpacon.io:8443", "alpacon.io:8443", false},
+		{"other port", "https://alpacon.io:8443", "alpacon.io:443", true},
+		{"default https port", "wss://alpacon.io/ws/", "alpacon.io:443", false},
+		{"default http port", "http://alpacon.io", "alpacon.io:80", false},
+		{"default port mismatch", "http://alpacon.io", "alpacon.io:443", true},
+		{"ip", "http://10.0.0.1", "10.0.0.1", false},
+		{"other ip", "http://10.0.0.2", "10.0.0.1", true},
+		{"ip with port", "http://10.0.0.1:8000", "10.0.0.1:8000", false},
+		{"ipv6", "http://[2001:db8::1]/", "2001:db8::1", false},
+		{"ipv6 with port", "http://[2001:db8::1]:8000/", "[2001:db8::1]:8000", false},
+		{"cidr", "http://10.1.2.3", "10.0.0.0/8", false},
+		{"outside cidr", "http://192.168.0.1", "10.0.0.0/8", true},
+		{"ipv6 cidr", "http://[2001:db8::1]/", "2001:db8::/32", false},
+		{"cidr does not match names", "http://ten.example", "10.0.0.0/8", true},
+		{"star", "https://alpacon.io", "*", false},
+		{"star in list", "https://alpacon.io", "example.com, *", false},
+		{"localhost", "http://localhost:8000", "", false},
+		{"loopback", "http://127.0.0.1:8000", "", false},
+		{"ipv6 loopback", "http://[::1]:8000", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			require.NoError(t, err)
+			assert.Equal(t, tt.proxied, useProxy(u, tt.noProxy))
+		})
+	}
+}
+
+func TestNewProxyFunc(t *testing.T) {
+	proxy, err := NewProxyFunc("http://proxy.example.com:3128", "user", "p@ss", ".internal")
+	require.NoError(t, err)
+
+	req, err := http.NewRequest(http.MethodGet, "https://alpacon.io/api/", nil)
+	require.NoError(t, err)
+	proxyURL, err := proxy(req)
+	require.NoError(t, err)
+	require.NotNil(t, proxyURL)
+	assert.Equal(t, "proxy.example.com:3128", proxyURL.Host)
+	password, _ := proxyURL.User.Password()
+	assert.Equal(t, "user", proxyURL.User.Username())
+	assert.Equal(t, "p@ss", password)
+
+	req, err = http.NewRequest(http.MethodGet, "https://db.internal/", nil)
+	require.NoError(t, err)
+	proxyURL, err = proxy(req)
+	require.NoError(t, err)
+	assert.Nil(t, proxyURL)
+
+	proxy, err = NewProxyFunc("socks5://proxy.example.com:1080", "", "", "")
+	require.NoError(t, err)
+	req, err = http.NewRequest(http.MethodGet, "https://alpacon.io/", nil)
+	require.NoError(t, err)
+	proxyURL, err = proxy(req)
+	require.NoError(t, err)
+	assert.Equal(t, "socks5", proxyURL.Scheme)
+	assert.Nil(t, proxyURL.User)
+
+	_, err = NewProxyFunc("http://proxy.example.com:port", "", "", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/alpacanetworks/alpamon/pkg/config"
+)
+
+// NewTLSConfig returns the TLS configuration for connections to Alpacon built from the [ssl] settings.
+// Files are read on every call, so renewed certificates are picked up by new connections.
+func NewTLSConfig() (*tls.Config, error) {
+	var caCert, clientCert, clientKey []byte
+	var err error
+
+	if config.GlobalSettings.CaCert != "" {
+		caCert, err = os.ReadFile(config.GlobalSettings.CaCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+	}
+
+	if config.GlobalSettings.ClientCert != "" {
+		clientCert, err = os.ReadFile(config.GlobalSettings.ClientCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client certificate: %w", err)
+		}
+		clientKey, err = os.ReadFile(config.GlobalSettings.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client key: %w", err)
+		}
+	}
+
+	tlsConfig, err := buildTLSConfig(caCert, clientCert, clientKey, config.GlobalSettings.SSLVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	var serverURLs []string
+	for _, endpoint := range config.GlobalSettings.Endpoints {
+		serverURLs = append(serverURLs, endpoint.ServerURL)
+	}
+	PinTLSConfig(tlsConfig, config.GlobalSettings.SSLPins, serverURLs)
+
+	return tlsConfig, nil
+}
+
+// buildTLSConfig is like NewTLSConfig, but takes PEM encoded data instead of file paths.
+func buildTLSConfig(caCert, clientCert, clientKey []byte, verify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: !verify,
+	}
+
+	if len(caCert) > 0 {
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if len(clientCert) > 0 {
+		cert, err := tls.X509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// PinTLSConfig makes connections to the hosts of serverURLs fail unless a certificate of the chain
+// has one of the given subject public key hashes, whichever CA has issued it.
+// Pins are checked even if verification is turned off. Connections to other hosts, e.g. file downloads
+// from a storage service, are not pinned, except those to an IP address as the host name is not known then.
+func PinTLSConfig(tlsConfig *tls.Config, pins [][]byte, serverURLs []string) {
+	if len(pins) == 0 {
+		return
+	}
+
+	var hosts []string
+	for _, serverURL := range serverURLs {
+		if u, err := url.Parse(serverURL); err == nil {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		if cs.ServerName != "" && !slices.ContainsFunc(hosts, func(host string) bool {
+			return strings.EqualFold(cs.ServerName, host)
+		}) {
+			return nil
+		}
+
+		for _, cert := range cs.PeerCertificates {
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(hash[:], pin) {
+					return nil
+				}
+			}
+		}
+
+		return errors.New("certificate does not match any pinned public key")
+	}
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCert issues a certificate from template, signed by parent, or self-signed if parent is nil.
+func newCert(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return cert, key
+}
+
+func pinOf(cert *x509.Certificate) []byte {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hash[:]
+}
+
+// newPinnedServer starts a TLS server with a certificate for alpacon.test issued by a CA,
+// and returns its address, the CA and the server certificate.
+func newPinnedServer(t *testing.T) (string, *x509.Certificate, *x509.Certificate) {
+	ca, caKey := newCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	leaf, leafKey := newCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "alpacon.test"},
+		DNSNames:    []string{"alpacon.test", "storage.test"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{leaf.Raw, ca.Raw},
+			PrivateKey:  leafKey,
+		}},
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server.Listener.Addr().String(), ca, leaf
+}
+
+func TestPinTLSConfig(t *testing.T) {
+	addr, ca, leaf := newPinnedServer(t)
+	otherCert, _ := newCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "other"}}, nil, nil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	serverURLs := []string{"https://alpacon.test", "https://standby.test:8443"}
+
+	tests := []struct {
+		name       string
+		pins       [][]byte
+		serverName string
+		verify     bool
+		ok         bool
+	}{
+		{"leaf pin", [][]byte{pinOf(leaf)}, "alpacon.test", true, true},
+		{"ca pin", [][]byte{pinOf(ca)}, "alpacon.test", true, true},
+		{"one of the pins", [][]byte{pinOf(otherCert), pinOf(leaf)}, "alpacon.test", true, true},
+		{"mismatched pin", [][]byte{pinOf(otherCert)}, "alpacon.test", true, false},
+		{"mismatched pin without verification", [][]byte{pinOf(otherCert)}, "alpacon.test", false, false},
+		{"pin without verification", [][]byte{pinOf(ca)}, "alpacon.test", false, true},
+		{"other host", [][]byte{pinOf(otherCert)}, "storage.test", true, true},
+		{"ip address", [][]byte{pinOf(otherCert)}, "127.0.0.1", true, false},
+		{"no pins", nil, "alpacon.test", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig := &tls.Config{
+				RootCAs:            roots,
+				ServerName:         tt.serverName,
+				InsecureSkipVerify: !tt.verify,
+			}
+			PinTLSConfig(tlsConfig, tt.pins, serverURLs)
+
+			conn, err := tls.Dial("tcp", addr, tlsConfig)
+			if tt.ok {
+				require.NoError(t, err)
+				_ = conn.Close()
+			} else {
+				assert.ErrorContains(t, err, "pinned public key")
+			}
+		})
+	}
+}
+
+func TestPinTLSConfigUntrustedChain(t *testing.T) {
+	addr, ca, _ := newPinnedServer(t)
+
+	// a pin does not replace the verification of the chain
+	tlsConfig := &tls.Config{ServerName: "alpacon.test", RootCAs: x509.NewCertPool()}
+	PinTLSConfig(tlsConfig, [][]byte{pinOf(ca)}, []string{"https://alpacon.test"})
+
+	_, err := tls.Dial("tcp", addr, tlsConfig)
+	var unknownAuthority x509.UnknownAuthorityError
+	assert.ErrorAs(t, err, &unknownAuthority)
+}